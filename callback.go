@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+const (
+	callbackTimeout  = 5 * time.Second
+	callbackAttempts = 3
+)
+
+var errCallbackAddress = errors.New("callback address is not public")
+
+// callbackClient only connects to public addresses, so that a callback_url
+// can't make the server call itself, e.g. its loopback only /shutdown, or
+// another internal service. The address is checked once it is resolved,
+// which also covers host names that resolve to an internal address. Redirects
+// are not followed and no proxy is used, as they would bypass the check.
+var callbackClient = &http.Client{
+	Timeout: callbackTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: callbackTimeout,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				addrPort, err := netip.ParseAddrPort(address)
+				if err != nil || !publicAddr(addrPort.Addr()) {
+					return fmt.Errorf("%w: %s", errCallbackAddress, address)
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: callbackTimeout,
+	},
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// publicAddr reports whether a callback may be sent to addr.
+func publicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return !addr.IsLoopback() && !addr.IsPrivate() && !addr.IsLinkLocalUnicast() &&
+		!addr.IsLinkLocalMulticast() && !addr.IsInterfaceLocalMulticast() && !addr.IsUnspecified()
+}
+
+type callbackURLKey struct{}
+
+// validCallbackURL reports whether rawURL is an absolute http or https URL.
+// A host that is an internal IP address, or localhost, is refused right away,
+// other hosts are checked when the callback connects.
+func validCallbackURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return false
+	}
+	if addr, err := netip.ParseAddr(u.Hostname()); err == nil {
+		return publicAddr(addr)
+	}
+	return u.Hostname() != "localhost"
+}
+
+// callbackURLFromContext returns the ?callback_url=... of the request that
+// scheduled the hash.
+func callbackURLFromContext(ctx context.Context) string {
+	callbackURL, _ := ctx.Value(callbackURLKey{}).(string)
+	return callbackURL
+}
+
+// notifyCallback posts {"id":<id>,"hash":<hash>} to callbackURL, retrying
+// with a growing delay if the request fails or doesn't return a 2xx status.
+func (hs *hashStore) notifyCallback(callbackURL string, hashId int, entry hashedEntry) {
+	body, err := json.Marshal(map[string]interface{}{"id": hs.jsonID(hashId), "hash": entry.String()})
+	if err != nil {
+		log.Printf("unable to encode the callback for hash id %d: %v", hashId, err)
+		return
+	}
+
+	for attempt := 1; ; attempt++ {
+		err = postCallback(callbackURL, body)
+		if err == nil {
+			return
+		}
+		if attempt == callbackAttempts {
+			log.Printf("unable to notify %s of hash id %d: %v", callbackURL, hashId, err)
+			return
+		}
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+}
+
+func postCallback(callbackURL string, body []byte) error {
+	resp, err := callbackClient.Post(callbackURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Config holds the server settings. Each one is set, in order of precedence,
+// by its command line flag, its environment variable, the -config file or
+// its default.
+type Config struct {
+	ListenAddr           string
+	UnixSocket           string
+	AllowRemoteShutdown  bool
+	ShutdownToken        string
+	ShutdownTimeout      time.Duration
+	HashAlgorithm        string
+	BcryptCost           int
+	HMACKey              string
+	PepperFile           string
+	HashDelay            time.Duration
+	DataFile             string
+	DBPath               string
+	RedisAddr            string
+	HashTTL              time.Duration
+	MaxHashes            int
+	HashShards           int
+	HashWorkers          int
+	HashQueueSize        int
+	AbandonPendingHashes bool
+	Dedup                bool
+	IdempotencyTTL       time.Duration
+	MaxHashWait          time.Duration
+	LogFormat            string
+	TLSCert              string
+	TLSKey               string
+	RateLimit            float64
+	RateBurst            int
+	MaxPasswordBytes     int
+	MaxConns             int
+	H2C                  bool
+	ReadTimeout          time.Duration
+	WriteTimeout         time.Duration
+	IdleTimeout          time.Duration
+	CORSOrigins          string
+	BasePath             string
+	IDFormat             string
+	IDKeyFile            string
+	ResponseStyle        string
+	UploadTimeout        time.Duration
+	LogLevel             string
+	MaxUploadBytes       int64
+	ConfigPath           string
+}
+
+// registerFlags binds the command line flags to the config fields.
+func (c *Config) registerFlags(flags *flag.FlagSet) {
+	flags.StringVar(&c.ListenAddr, "listen-addr", defaultServerListenAddr, "server listen address")
+	flags.BoolVar(&c.AllowRemoteShutdown, "allow-remote-shutdown", false, "allow /shutdown and /drain requests from non-loopback addresses")
+	flags.StringVar(&c.ShutdownToken, "shutdown-token", "", "token required to call /shutdown and /drain from any address")
+	flags.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", defaultShutdownTimeout, "maximum time to wait for in-flight requests and pending hashes on shutdown")
+	flags.StringVar(&c.HashAlgorithm, "hash-algorithm", defaultHashAlgorithm, "default hash algorithm(sha1, sha224, sha256, sha384, sha512, sha512-256, sha3-256, sha3-384, sha3-512, bcrypt)")
+	flags.IntVar(&c.BcryptCost, "bcrypt-cost", bcrypt.DefaultCost, "bcrypt cost factor")
+	flags.StringVar(&c.HMACKey, "hmac-key", "", "secret key used to compute HMAC digests")
+	flags.StringVar(&c.PepperFile, "pepper-file", "", "file holding a secret appended to every password before hashing")
+	flags.DurationVar(&c.HashDelay, "hash-delay", defaultHashDelay, "delay before a hash is computed, 0 computes it immediately")
+	flags.StringVar(&c.DataFile, "data-file", "", "JSON file the hashes are persisted to across restarts")
+	flags.StringVar(&c.DBPath, "db-path", "", "SQLite database the hashes are stored in, instead of memory")
+	flags.StringVar(&c.RedisAddr, "redis-addr", "", "Redis server the hashes are stored in, to share them between server instances")
+	flags.DurationVar(&c.HashTTL, "hash-ttl", 0, "how long the hashes are kept, 0 keeps them forever")
+	flags.IntVar(&c.MaxHashes, "max-hashes", 0, "maximum number of stored hashes, the least recently accessed are evicted. 0 is unlimited")
+	flags.IntVar(&c.HashShards, "hash-shards", 1, "number of separately locked shards the in-memory hashes are split over")
+	flags.IntVar(&c.HashWorkers, "hash-workers", 0, "number of goroutines computing the hashes, 0 uses one per hash")
+	flags.IntVar(&c.HashQueueSize, "hash-queue-size", defaultHashQueueSize, "maximum number of pending hashes with -hash-workers, above it POST /hash returns 503")
+	flags.BoolVar(&c.AbandonPendingHashes, "abandon-pending-hashes", false, "abandon the pending hashes on shutdown instead of waiting for them to be computed")
+	flags.BoolVar(&c.Dedup, "dedup", false, "return the id of the existing hash when the same password, algorithm and encoding are submitted again")
+	flags.DurationVar(&c.IdempotencyTTL, "idempotency-ttl", defaultIdempotencyTTL, "how long the ids assigned to a POST /hash with an Idempotency-Key header are returned for retries")
+	flags.DurationVar(&c.MaxHashWait, "max-wait", 0, "maximum time GET /hash/<id>?wait=true waits for a pending hash(default hash delay + 2s)")
+	flags.StringVar(&c.LogFormat, "log-format", textLogFormat, "log output format(text, json)")
+	flags.StringVar(&c.TLSCert, "tls-cert", "", "TLS certificate file, serves HTTPS together with -tls-key")
+	flags.StringVar(&c.TLSKey, "tls-key", "", "TLS private key file, serves HTTPS together with -tls-cert")
+	flags.Float64Var(&c.RateLimit, "rate-limit", 0, "maximum POST /hash, /digest and /verify requests per second per client IP, 0 is unlimited")
+	flags.IntVar(&c.RateBurst, "rate-burst", 10, "number of POST /hash, /digest and /verify requests a client IP can make at once above -rate-limit")
+	flags.IntVar(&c.MaxPasswordBytes, "max-password-bytes", defaultMaxPasswordBytes, "maximum password length in bytes")
+	flags.IntVar(&c.MaxConns, "max-conns", 0, "maximum number of concurrent connections, over all listen addresses, 0 is unlimited")
+	flags.BoolVar(&c.H2C, "h2c", false, "also serve HTTP/2 without TLS(h2c) to clients that start with the HTTP/2 preface")
+	flags.DurationVar(&c.ReadTimeout, "read-timeout", defaultReadTimeout, "maximum time to read a request, including the body")
+	flags.DurationVar(&c.WriteTimeout, "write-timeout", defaultWriteTimeout, "maximum time to write a response")
+	flags.DurationVar(&c.IdleTimeout, "idle-timeout", defaultIdleTimeout, "maximum time an idle keep-alive connection is kept open")
+	flags.StringVar(&c.UnixSocket, "unix-socket", "", "unix socket path to listen on instead of -listen-addr")
+	flags.StringVar(&c.CORSOrigins, "cors-origins", "", "comma-separated list of origins allowed to make cross-origin requests, * allows any")
+	flags.StringVar(&c.BasePath, "base-path", "", "path prefix all the routes are served under, e.g. /hashsvc behind a reverse proxy")
+	flags.StringVar(&c.IDFormat, "id-format", integerIDFormat, "format of the hash ids(integer, uuid). uuid ids are opaque and can't be enumerated")
+	flags.StringVar(&c.IDKeyFile, "id-key-file", "", "file holding the secret key the uuid ids are derived with, so they stay valid across restarts(default a random key per process)")
+	flags.StringVar(&c.ResponseStyle, "response-style", plainResponseStyle, "response to a POST /hash(plain, json). json returns {\"id\":<id>,\"status\":\"pending\",\"ready_at\":<time>} instead of the bare id")
+	flags.DurationVar(&c.UploadTimeout, "upload-timeout", defaultUploadTimeout, "maximum time to read a streamed body, which replaces -read-timeout and -write-timeout for it")
+	flags.StringVar(&c.LogLevel, "log-level", "info", "minimum level of the logged messages(debug, info, warn, error)")
+	flags.Int64Var(&c.MaxUploadBytes, "max-upload-bytes", defaultMaxUploadBytes, "maximum size in bytes of a streamed application/octet-stream or multipart/form-data body")
+	flags.StringVar(&c.ConfigPath, "config", "", "YAML or JSON config file, reloaded on SIGHUP. Command line flags and environment variables take precedence")
+}
+
+// loadConfig reads the config from the command line arguments, the
+// environment and the config file, and validates it.
+func loadConfig(args []string) (*Config, error) {
+	config := &Config{}
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	config.registerFlags(flags)
+	flags.Parse(args)
+
+	if err := applyEnvironment(flags); err != nil {
+		return nil, err
+	}
+	if config.ConfigPath != "" {
+		if err := applyConfigFile(flags, config.ConfigPath); err != nil {
+			return nil, fmt.Errorf("invalid config file %s: %w", config.ConfigPath, err)
+		}
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func (c *Config) validate() error {
+	hashConfig := c.hashConfig()
+	if err := hashConfig.validate(); err != nil {
+		return err
+	}
+	if c.HashTTL < 0 {
+		return fmt.Errorf("invalid hash TTL: %v", c.HashTTL)
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return errors.New("both -tls-cert and -tls-key must be set to serve HTTPS")
+	}
+	if c.RateLimit < 0 || c.RateBurst < 1 {
+		return fmt.Errorf("invalid rate limit: %v requests/s, burst %d", c.RateLimit, c.RateBurst)
+	}
+	if c.HashWorkers < 0 || c.HashQueueSize < 1 {
+		return fmt.Errorf("invalid hash workers: %d, queue size %d", c.HashWorkers, c.HashQueueSize)
+	}
+	if c.MaxConns < 0 {
+		return fmt.Errorf("invalid max conns: %d", c.MaxConns)
+	}
+	if c.ResponseStyle != plainResponseStyle && c.ResponseStyle != jsonResponseStyle {
+		return fmt.Errorf("unsupported response style: %s", c.ResponseStyle)
+	}
+	if c.IDFormat != integerIDFormat && c.IDFormat != uuidIDFormat {
+		return fmt.Errorf("unsupported id format: %s", c.IDFormat)
+	}
+	// Without a key file the UUIDs are derived with a per process key, the
+	// ones of the hashes stored before a restart would no longer resolve.
+	if c.IDFormat == uuidIDFormat && c.IDKeyFile == "" && (c.DataFile != "" || c.DBPath != "" || c.RedisAddr != "") {
+		return errors.New("-id-format=uuid needs -id-key-file with -data-file, -db-path or -redis-addr")
+	}
+	if c.BasePath != "" && !strings.HasPrefix(c.BasePath, "/") {
+		return fmt.Errorf("invalid base path: %s. Must start with /", c.BasePath)
+	}
+	if c.MaxUploadBytes < 1 {
+		return fmt.Errorf("invalid max upload bytes: %d", c.MaxUploadBytes)
+	}
+	if c.UploadTimeout <= 0 {
+		return fmt.Errorf("invalid upload timeout: %v", c.UploadTimeout)
+	}
+	if c.IdempotencyTTL <= 0 {
+		return fmt.Errorf("invalid idempotency TTL: %v", c.IdempotencyTTL)
+	}
+	return nil
+}
+
+// hashConfig returns the settings that can be reloaded at runtime.
+func (c *Config) hashConfig() hashConfig {
+	return hashConfig{
+		hashAlgorithm:    c.HashAlgorithm,
+		bcryptCost:       c.BcryptCost,
+		hashDelay:        c.HashDelay,
+		maxHashWait:      c.MaxHashWait,
+		maxPasswordBytes: c.MaxPasswordBytes,
+	}
+}
+
+// applyEnvironment sets the flags that weren't given on the command line from
+// environment variables named after them, e.g. HASH_DELAY for -hash-delay.
+func applyEnvironment(flags *flag.FlagSet) error {
+	setFlags := visitedFlags(flags)
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		if setFlags[f.Name] || err != nil {
+			return
+		}
+		name := strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if value, ok := os.LookupEnv(name); ok {
+			if setErr := flags.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("invalid %s: %w", name, setErr)
+			}
+		}
+	})
+	return err
+}
+
+// applyConfigFile sets the flags that weren't given on the command line or
+// the environment from the config file. The file's keys are the flag names,
+// with either dashes or underscores.
+func applyConfigFile(flags *flag.FlagSet, path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var settings map[string]string
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		settings, err = parseYAMLConfig(content)
+	default:
+		settings, err = parseJSONConfig(content)
+	}
+	if err != nil {
+		return err
+	}
+
+	setFlags := visitedFlags(flags)
+	for key, value := range settings {
+		name := strings.ReplaceAll(key, "_", "-")
+		if flags.Lookup(name) == nil || name == "config" {
+			return fmt.Errorf("unknown setting: %s", key)
+		}
+		if setFlags[name] {
+			continue
+		}
+		if err := flags.Set(name, value); err != nil {
+			return fmt.Errorf("invalid %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// visitedFlags returns the names of the flags that have been set.
+func visitedFlags(flags *flag.FlagSet) map[string]bool {
+	setFlags := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+	return setFlags
+}
+
+// parseJSONConfig reads a JSON object of settings. Lists, e.g. of listen
+// addresses, are joined with commas.
+func parseJSONConfig(content []byte) (map[string]string, error) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(content, &raw); err != nil {
+		return nil, err
+	}
+
+	settings := make(map[string]string, len(raw))
+	for key, value := range raw {
+		switch v := value.(type) {
+		case string:
+			settings[key] = v
+		case float64:
+			settings[key] = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			settings[key] = strconv.FormatBool(v)
+		case []interface{}:
+			items := make([]string, 0, len(v))
+			for _, item := range v {
+				s, ok := item.(string)
+				if !ok {
+					return nil, fmt.Errorf("%s: list items must be strings", key)
+				}
+				items = append(items, s)
+			}
+			settings[key] = strings.Join(items, ",")
+		default:
+			return nil, fmt.Errorf("%s: unsupported value %v", key, value)
+		}
+	}
+	return settings, nil
+}
+
+// parseYAMLConfig reads a flat YAML mapping of settings, "key: value" per
+// line. Comments, quoted values and lists of scalars("- item" lines under
+// a key without a value) are supported, nested mappings are not.
+func parseYAMLConfig(content []byte) (map[string]string, error) {
+	settings := make(map[string]string)
+	var listKey string
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || line == "---" {
+			continue
+		}
+
+		if item, ok := strings.CutPrefix(line, "- "); ok {
+			if listKey == "" {
+				return nil, fmt.Errorf("line %d: list item without a key", lineNumber)
+			}
+			if settings[listKey] != "" {
+				settings[listKey] += ","
+			}
+			settings[listKey] += yamlScalar(item)
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key: value", lineNumber)
+		}
+		key = strings.TrimSpace(key)
+		value = yamlScalar(value)
+		settings[key] = value
+		listKey = ""
+		if value == "" {
+			listKey = key
+		}
+	}
+	return settings, scanner.Err()
+}
+
+// yamlScalar strips the quotes or a trailing comment from a YAML value.
+func yamlScalar(value string) string {
+	value = strings.TrimSpace(value)
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		if value[0] == '"' {
+			if unquoted, err := strconv.Unquote(value); err == nil {
+				return unquoted
+			}
+		}
+		return value[1 : len(value)-1]
+	}
+	if i := strings.Index(value, " #"); i >= 0 {
+		value = strings.TrimSpace(value[:i])
+	}
+	return value
+}
+
+// hashConfig holds the settings that can be changed without a restart by
+// reloading the config file on SIGHUP. The handlers load it once per request.
+type hashConfig struct {
+	hashAlgorithm    string
+	bcryptCost       int
+	hashDelay        time.Duration
+	maxHashWait      time.Duration
+	maxPasswordBytes int
+}
+
+func (c *hashConfig) validate() error {
+	if !isSupportedHashAlgorithm(c.hashAlgorithm) {
+		return fmt.Errorf("unsupported hash algorithm: %s", c.hashAlgorithm)
+	}
+	if c.bcryptCost < bcrypt.MinCost || c.bcryptCost > bcrypt.MaxCost {
+		return fmt.Errorf("invalid bcrypt cost: %d. Must be between %d and %d", c.bcryptCost, bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	if c.hashDelay < 0 {
+		return fmt.Errorf("invalid hash delay: %v", c.hashDelay)
+	}
+	if c.maxHashWait < 0 {
+		return fmt.Errorf("invalid max wait: %v", c.maxHashWait)
+	}
+	if c.maxPasswordBytes < 1 || c.maxPasswordBytes > maxRequestBodyBytes {
+		return fmt.Errorf("invalid max password bytes: %d. Must be between 1 and %d", c.maxPasswordBytes, maxRequestBodyBytes)
+	}
+	return nil
+}
+
+// maxWait is how long GET /hash/<id>?wait=true waits, by default a bit longer
+// than the hash delay.
+func (c *hashConfig) maxWait() time.Duration {
+	if c.maxHashWait == 0 {
+		return c.hashDelay + maxHashWaitGracePeriod
+	}
+	return c.maxHashWait
+}
+
+// reloadConfigOnSignal reloads the config on SIGHUP. Only the hash settings
+// take effect without a restart. An invalid config is logged and the current
+// one is kept.
+func (hs *hashStore) reloadConfigOnSignal(logger *log.Logger) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			config, err := loadConfig(os.Args[1:])
+			if err != nil {
+				logger.Printf("Could not reload the config: %v\n", err)
+				continue
+			}
+			hashConfig := config.hashConfig()
+			hs.config.Store(&hashConfig)
+			logger.Println("Config reloaded from", config.ConfigPath)
+		}
+	}()
+}
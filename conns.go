@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+// newConnSlots returns the semaphore bounding the concurrent connections to
+// maxConns, nil if they are unlimited.
+func newConnSlots(maxConns int) chan struct{} {
+	if maxConns == 0 {
+		return nil
+	}
+	return make(chan struct{}, maxConns)
+}
+
+// limitListener only accepts a connection once a slot is free, the waiting
+// connections stay in the listen backlog. The slot is freed when the
+// connection is closed. The listeners of all the listen addresses share the
+// slots. Close stops the wait for a slot, so that a shutdown isn't held up
+// while all the slots are taken.
+type limitListener struct {
+	net.Listener
+	slots     chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newLimitListener(l net.Listener, slots chan struct{}) *limitListener {
+	return &limitListener{Listener: l, slots: slots, done: make(chan struct{})}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	select {
+	case l.slots <- struct{}{}:
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		<-l.slots
+		return nil, err
+	}
+	return &limitConn{Conn: conn, release: func() { <-l.slots }}, nil
+}
+
+func (l *limitListener) Close() error {
+	err := l.Listener.Close()
+	l.closeOnce.Do(func() { close(l.done) })
+	return err
+}
+
+// limitConn frees its slot on the first Close.
+type limitConn struct {
+	net.Conn
+	releaseOnce sync.Once
+	release     func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.releaseOnce.Do(c.release)
+	return err
+}
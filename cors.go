@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+const (
+	corsAllowedMethods = "GET, POST, DELETE, OPTIONS"
+	corsAllowedHeaders = "Content-Type, Authorization, X-Request-ID, Idempotency-Key"
+)
+
+// withCORS adds the CORS headers for requests from the allowed origins and
+// answers their preflight requests. "*" allows any origin. Without allowed
+// origins the handler is returned unchanged.
+func withCORS(allowedOrigins []string, next http.Handler) http.Handler {
+	if len(allowedOrigins) == 0 {
+		return next
+	}
+	allowAny := slices.Contains(allowedOrigins, "*")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		w.Header().Add("Vary", "Origin")
+		if origin == "" || !(allowAny || slices.Contains(allowedOrigins, origin)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Expose-Headers", requestIDHeader)
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", corsAllowedMethods)
+			w.Header().Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+			w.WriteHeader(httpNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// parseOrigins splits a comma-separated list of origins.
+func parseOrigins(origins string) []string {
+	var parsed []string
+	for _, origin := range strings.Split(origins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			parsed = append(parsed, origin)
+		}
+	}
+	return parsed
+}
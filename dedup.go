@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+)
+
+// dedupIndex maps the inputs of the scheduled hashes to their ids so that an
+// identical input gets the existing id. The inputs are keyed by an HMAC with a
+// random per process key, so the index doesn't hold plain digests of the
+// passwords. keys maps the ids back to their inputs, so that the input of a
+// deleted hash can be forgotten.
+type dedupIndex struct {
+	mutex sync.Mutex
+	key   []byte
+	ids   map[string]int
+	keys  map[int]string
+}
+
+func newDedupIndex() *dedupIndex {
+	key := make([]byte, sha256.Size)
+	rand.Read(key)
+	return &dedupIndex{key: key, ids: make(map[string]int), keys: make(map[int]string)}
+}
+
+func (d *dedupIndex) inputKey(password []byte, algorithm, encoding string) string {
+	mac := hmac.New(sha256.New, d.key)
+	mac.Write([]byte(algorithm))
+	mac.Write([]byte{0})
+	mac.Write([]byte(encoding))
+	mac.Write([]byte{0})
+	mac.Write(password)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// reserveDedupedHash returns the id of a pending or stored hash of the same
+// input, otherwise it reserves a new one and adds it to the index. reserved
+// reports whether the id is new and has to be scheduled.
+func (hs *hashStore) reserveDedupedHash(password []byte, algorithm, encoding string) (hashId int, reserved bool, err error) {
+	key := hs.dedup.inputKey(password, algorithm, encoding)
+
+	// The index is only locked to look the input up and to add it, not while
+	// the hash is computed, which happens right away without a hash delay.
+	hs.dedup.mutex.Lock()
+	seenID, seen := hs.dedup.ids[key]
+	hs.dedup.mutex.Unlock()
+	if seen {
+		exists, err := hs.hashExists(seenID)
+		if err != nil || exists {
+			return seenID, false, err
+		}
+	}
+
+	// The reserved id is pending, so an identical input that finds it in the
+	// index waits for it instead of scheduling its own.
+	hashId, err = hs.reserveHash()
+	if err != nil {
+		return 0, false, err
+	}
+	hs.dedup.mutex.Lock()
+	if current, ok := hs.dedup.ids[key]; ok && current != seenID {
+		// An identical input was scheduled in the meantime.
+		hs.dedup.mutex.Unlock()
+		hs.abandonHash(hashId)
+		return current, false, nil
+	}
+	if seen {
+		delete(hs.dedup.keys, seenID)
+	}
+	hs.dedup.ids[key] = hashId
+	hs.dedup.keys[hashId] = key
+	hs.dedup.mutex.Unlock()
+	return hashId, true, nil
+}
+
+// forget removes the input of a deleted or expired hash from the index.
+func (d *dedupIndex) forget(id int) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if key, ok := d.keys[id]; ok {
+		delete(d.keys, id)
+		if d.ids[key] == id {
+			delete(d.ids, key)
+		}
+	}
+}
+
+// hashExists reports whether the hash is pending or stored and not expired.
+func (hs *hashStore) hashExists(id int) (bool, error) {
+	hs.pendingHashesMutex.Lock()
+	_, pending := hs.pendingHashes[id]
+	hs.pendingHashesMutex.Unlock()
+	if pending {
+		return true, nil
+	}
+
+	entry, ok, err := hs.storage.Get(id)
+	if err != nil {
+		return false, err
+	}
+	return ok && !hs.isExpired(entry), nil
+}
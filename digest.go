@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// digestPassword computes the hash of a single password right away and
+// returns it as {"hash":<salt>:<hash>} without storing it, so no id is
+// allocated. Only the computation is counted in /stats, not the request.
+func (hs *hashStore) digestPassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeJSONError(w, httpMethodNotAllowed, "Method not allowed.")
+		return
+	}
+
+	config := hs.config.Load()
+	algorithm, encoding, ok := requestAlgorithmAndEncoding(w, r, config)
+	if !ok {
+		return
+	}
+
+	passwords, err := readPasswords(w, r)
+	if err != nil || len(passwords) != 1 || passwords[0] == "" {
+		writeJSONError(w, httpBadRequest, "A single password is required.")
+		return
+	}
+	if len(passwords[0]) > config.maxPasswordBytes {
+		writeJSONError(w, httpBadRequest, fmt.Sprintf("Password is longer than %d bytes.", config.maxPasswordBytes))
+		return
+	}
+	if algorithm == bcryptAlgorithm && len(passwords[0]) > hs.maxBcryptPasswordBytes() {
+		writeJSONError(w, httpBadRequest, fmt.Sprintf("Password is longer than %d bytes, the bcrypt limit.", hs.maxBcryptPasswordBytes()))
+		return
+	}
+
+	entry, err := hs.computeHash([]byte(passwords[0]), algorithm, encoding)
+	if err != nil {
+		log.Printf("request %s: unable to compute the hash: %v", requestIDFromContext(r.Context()), err)
+		writeJSONError(w, httpInternalServerError, "Internal server error.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpOK)
+	err = json.NewEncoder(w).Encode(map[string]string{"hash": entry.String()})
+	logWriteError(r, err)
+}
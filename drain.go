@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// startDraining stops the intake of new hashes ahead of a shutdown. The
+// pending hashes are still computed and everything else is still served.
+func (srv *hashServer) startDraining() {
+	if !srv.draining.Swap(true) {
+		srv.logger.Println("Server is draining, new hashes are refused")
+	}
+}
+
+// drain puts the server in drain mode, e.g. before a rolling deploy stops it.
+func (srv *hashServer) drain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeJSONError(w, httpMethodNotAllowed, "Method not allowed.")
+		return
+	}
+
+	srv.startDraining()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpAccepted)
+	writeString(w, r, `{"status":"draining"}`+"\n")
+}
+
+// drainOnSignal puts the server in drain mode on SIGUSR1.
+func (srv *hashServer) drainOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	go func() {
+		for sig := range signals {
+			srv.logger.Println("Received signal:", sig)
+			srv.startDraining()
+		}
+	}()
+}
+
+// refuseWhileDraining rejects the POST requests with a 503 once the server is
+// draining.
+func (srv *hashServer) refuseWhileDraining(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && srv.draining.Load() {
+			writeJSONError(w, httpServiceUnavailable, "Server is draining, no new hashes are accepted.")
+			return
+		}
+		next(w, r)
+	}
+}
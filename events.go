@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// hashEvents streams a server-sent event once the hash is computed, carrying
+// the hash, and then closes the stream. A hash that is abandoned, e.g. by a
+// shutdown, gets an "abandoned" event instead.
+func (hs *hashStore) hashEvents(w http.ResponseWriter, r *http.Request) {
+	id, err := hs.parseID(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/hash/"), "/events"))
+	if err != nil {
+		writeJSONError(w, httpBadRequest, "Invalid hash id.")
+		return
+	}
+	lastID, err := hs.storage.LastID()
+	if err != nil {
+		log.Printf("request %s: unable to get the last hash id: %v", requestIDFromContext(r.Context()), err)
+		writeJSONError(w, httpInternalServerError, "Internal server error.")
+		return
+	}
+	if id > lastID || id < 1 {
+		writeJSONError(w, httpNotFound, "Hash not found.")
+		return
+	}
+
+	// The stream stays open until the hash is computed, which can take longer
+	// than the write timeout.
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(httpOK)
+	rc.Flush()
+
+	hs.pendingHashesMutex.Lock()
+	hashComputed, pending := hs.pendingHashes[id]
+	hs.pendingHashesMutex.Unlock()
+	if pending {
+		select {
+		case <-hashComputed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	entry, ok, err := hs.storage.Get(id)
+	if err != nil {
+		log.Printf("request %s: unable to get hash id %d: %v", requestIDFromContext(r.Context()), id, err)
+	}
+	if err != nil || !ok || hs.isExpired(entry) {
+		_, err = fmt.Fprintf(w, "event: abandoned\ndata: %s\n\n", hs.formatID(id))
+	} else {
+		_, err = fmt.Fprintf(w, "event: computed\ndata: %s\n\n", entry.String())
+	}
+	if err == nil {
+		err = rc.Flush()
+	}
+	logWriteError(r, err)
+}
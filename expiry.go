@@ -0,0 +1,59 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// minExpirySweepInterval bounds how often the expired hashes are swept.
+const minExpirySweepInterval = time.Second
+
+// isExpired reports whether the entry outlived the hash TTL.
+func (hs *hashStore) isExpired(entry hashedEntry) bool {
+	return hs.hashTTL > 0 && time.Since(entry.createdAt) > hs.hashTTL
+}
+
+// sweepExpiredHashes periodically deletes the expired hashes until stop is closed.
+func (hs *hashStore) sweepExpiredHashes(stop <-chan struct{}) {
+	interval := hs.hashTTL / 2
+	if interval < minExpirySweepInterval {
+		interval = minExpirySweepInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := hs.deleteExpiredHashes(); err != nil {
+				log.Printf("unable to delete expired hashes: %v", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (hs *hashStore) deleteExpiredHashes() error {
+	ids, err := hs.storage.IDs()
+	if err != nil {
+		return err
+	}
+	// Peek doesn't count the sweep as an access, which would reset the order
+	// the least recently accessed hashes are evicted in.
+	for _, id := range ids {
+		entry, ok, err := hs.storage.Peek(id)
+		if err != nil {
+			return err
+		}
+		if ok && hs.isExpired(entry) {
+			if _, err := hs.storage.Delete(id); err != nil {
+				return err
+			}
+			if hs.dedup != nil {
+				hs.dedup.forget(id)
+			}
+		}
+	}
+	return nil
+}
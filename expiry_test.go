@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpirySweepKeepsTheEvictionOrder(t *testing.T) {
+	config, err := loadConfig([]string{"-max-hashes", "2", "-hash-ttl", "1h"})
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	hs := newHashStore(config, newMemoryStore(config.MaxHashes), nil, nil)
+	entry := hashedEntry{algorithm: defaultHashAlgorithm, encoding: defaultEncoding, createdAt: time.Now()}
+
+	hs.storage.Put(1, entry)
+	hs.storage.Put(2, entry)
+	// 1 is now the most recently accessed hash, the sweep must not change that.
+	hs.storage.Get(1)
+	if err := hs.deleteExpiredHashes(); err != nil {
+		t.Fatalf("deleteExpiredHashes: %v", err)
+	}
+	hs.storage.Put(3, entry)
+
+	if _, ok, _ := hs.storage.Get(2); ok {
+		t.Errorf("hash 2 was kept, want it evicted as the least recently accessed")
+	}
+	if _, ok, _ := hs.storage.Get(1); !ok {
+		t.Errorf("hash 1 was evicted, want it kept as it was accessed after 2")
+	}
+}
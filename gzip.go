@@ -0,0 +1,123 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+// gzipMinSize is the smallest response that is compressed, smaller ones
+// aren't worth the overhead.
+const gzipMinSize = 1024
+
+// gzipResponseWriter buffers the start of a response until it is known to be
+// at least gzipMinSize bytes, then compresses it.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	status     int
+	buffer     []byte
+	gzipWriter *gzip.Writer
+	// decided is set once the response is being written, compressed or not.
+	decided bool
+}
+
+func (gw *gzipResponseWriter) WriteHeader(status int) {
+	// Informational responses are sent right away, they precede the response.
+	if status >= 100 && status < 200 {
+		gw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if gw.status == 0 {
+		gw.status = status
+	}
+}
+
+func (gw *gzipResponseWriter) Write(data []byte) (int, error) {
+	if gw.decided {
+		if gw.gzipWriter != nil {
+			return gw.gzipWriter.Write(data)
+		}
+		return gw.ResponseWriter.Write(data)
+	}
+
+	gw.buffer = append(gw.buffer, data...)
+	if len(gw.buffer) >= gzipMinSize {
+		if err := gw.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+// decide writes the header and the buffered data, compressed or not.
+func (gw *gzipResponseWriter) decide(compress bool) error {
+	gw.decided = true
+	header := gw.ResponseWriter.Header()
+	if compress && header.Get("Content-Encoding") == "" {
+		header.Set("Content-Encoding", "gzip")
+		header.Del("Content-Length")
+		if header.Get("Content-Type") == "" {
+			header.Set("Content-Type", http.DetectContentType(gw.buffer))
+		}
+		gw.gzipWriter = gzip.NewWriter(gw.ResponseWriter)
+	}
+	if gw.status != 0 {
+		gw.ResponseWriter.WriteHeader(gw.status)
+	}
+
+	if len(gw.buffer) == 0 {
+		return nil
+	}
+	var err error
+	if gw.gzipWriter != nil {
+		_, err = gw.gzipWriter.Write(gw.buffer)
+	} else {
+		_, err = gw.ResponseWriter.Write(gw.buffer)
+	}
+	gw.buffer = nil
+	return err
+}
+
+// Flush sends what has been written so far. A response flushed before it
+// reaches gzipMinSize is sent uncompressed.
+func (gw *gzipResponseWriter) Flush() {
+	if !gw.decided {
+		gw.decide(false)
+	}
+	if gw.gzipWriter != nil {
+		gw.gzipWriter.Flush()
+	}
+	http.NewResponseController(gw.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, e.g. to
+// change its deadlines.
+func (gw *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return gw.ResponseWriter
+}
+
+// close finishes the response.
+func (gw *gzipResponseWriter) close() error {
+	if !gw.decided {
+		return gw.decide(false)
+	}
+	if gw.gzipWriter != nil {
+		return gw.gzipWriter.Close()
+	}
+	return nil
+}
+
+// withGzip compresses the responses of clients that accept gzip.
+func withGzip(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(gw, r)
+		gw.close()
+	})
+}
@@ -1,185 +1,1695 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
 	"context"
-	"crypto/sha256"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha3"
+	_ "crypto/sha512"
+	"crypto/subtle"
 	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
-	"flag"
+	"errors"
 	"fmt"
+	"hash"
+	"io"
 	"log"
+	"log/slog"
+	"maps"
+	"mime"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
 const (
-	hashDelayIntervalSeconds = 5
-	gracefulShutdownTimeout  = 30
-	httpBadRequest           = 400
-	defaultServerListenAddr  = ":8080"
+	defaultHashDelay        = 5 * time.Second
+	defaultHashQueueSize    = 10000
+	defaultIdempotencyTTL   = 24 * time.Hour
+	defaultShutdownTimeout  = 30 * time.Second
+	defaultReadTimeout      = 10 * time.Second
+	defaultWriteTimeout     = 10 * time.Second
+	defaultIdleTimeout      = 60 * time.Second
+	defaultUploadTimeout    = 10 * time.Minute
+	httpEarlyHints          = 103
+	httpOK                  = 200
+	httpAccepted            = 202
+	httpNoContent           = 204
+	httpBadRequest          = 400
+	httpUnauthorized        = 401
+	httpForbidden           = 403
+	httpNotFound            = 404
+	httpInternalServerError = 500
+	httpMethodNotAllowed    = 405
+	httpConflict            = 409
+	httpUnprocessableEntity = 422
+	httpTooManyRequests     = 429
+	httpServiceUnavailable  = 503
+	httpGatewayTimeout      = 504
+	apiV1Prefix             = "/v1"
+	defaultServerListenAddr = ":8080"
+	defaultHashAlgorithm    = "sha256"
+	bcryptAlgorithm         = "bcrypt"
+	// maxBcryptInputBytes is the longest input bcrypt accepts, the password
+	// and the pepper together.
+	maxBcryptInputBytes     = 72
+	saltSize                = 16
+	defaultEncoding         = "base64"
+	plainResponseStyle      = "plain"
+	jsonResponseStyle       = "json"
+	defaultMaxPasswordBytes = 4096
+	// maxRequestBodyBytes caps the body of the requests that carry passwords.
+	maxRequestBodyBytes = 1 << 20
+	// defaultHashesPageLimit and maxHashesPageLimit bound a /hashes page.
+	defaultHashesPageLimit = 100
+	maxHashesPageLimit     = 1000
+	// abandonedHashesWait is how long shutdown waits for the hashes that are
+	// being computed when the pending ones are abandoned.
+	abandonedHashesWait    = 2 * time.Second
+	maxHashWaitGracePeriod = 2 * time.Second
 )
 
+// hashAlgorithms maps the algorithm names to the crypto.Hash registry. The
+// implementations register themselves through the blank imports above; an
+// algorithm whose implementation isn't linked in is not supported.
+var hashAlgorithms = map[string]crypto.Hash{
+	"sha1":       crypto.SHA1,
+	"sha224":     crypto.SHA224,
+	"sha256":     crypto.SHA256,
+	"sha384":     crypto.SHA384,
+	"sha512":     crypto.SHA512,
+	"sha512-256": crypto.SHA512_256,
+	"sha3-256":   crypto.SHA3_256,
+	"sha3-384":   crypto.SHA3_384,
+	"sha3-512":   crypto.SHA3_512,
+}
+
+var encodings = map[string]func([]byte) string{
+	"base64":    base64.StdEncoding.EncodeToString,
+	"base64url": base64.URLEncoding.EncodeToString,
+	"hex":       hex.EncodeToString,
+}
+
+func isSupportedHashAlgorithm(algorithm string) bool {
+	if algorithm == bcryptAlgorithm {
+		return true
+	}
+	h, ok := hashAlgorithms[algorithm]
+	return ok && h.Available()
+}
+
+type hashedEntry struct {
+	algorithm string
+	encoding  string
+	salt      []byte
+	hash      string
+	createdAt time.Time
+}
+
+// String returns the stored hash in the "salt:hash" format.
+// Entries without a separate salt(bcrypt) are returned as the hash only.
+func (e hashedEntry) String() string {
+	if e.salt == nil {
+		return e.hash
+	}
+	return encodings[e.encoding](e.salt) + ":" + e.hash
+}
+
 type hashStore struct {
-	hashedDataMutex   sync.Mutex
-	hashedDataCounter int
-	hashedData        map[int]string
+	startTime time.Time
+
+	// config holds the settings that can be reloaded at runtime.
+	config  atomic.Pointer[hashConfig]
+	hmacKey []byte
+	// pepper is a secret appended to every password before it is hashed.
+	pepper []byte
+
+	storage Storage
+	// hashTTL is how long the hashes are kept, 0 keeps them forever.
+	hashTTL     time.Duration
+	stopSweeper chan struct{}
+
+	pendingHashesMutex sync.Mutex
+	// pendingHashes holds a channel for every hash that is not computed yet.
+	// The channel is closed once the hash is computed.
+	pendingHashes map[int]chan struct{}
+	// pendingReadyAt holds when every pending hash is due, its reservation
+	// time plus the hash delay.
+	pendingReadyAt map[int]time.Time
+	// pendingHashesWaitGroup tracks the scheduled hash computations so that
+	// shutdown can wait for them to complete.
+	pendingHashesWaitGroup sync.WaitGroup
+	// hashCtx is cancelled on shutdown, the hashes that are still pending are
+	// then abandoned instead of stored.
+	hashCtx      context.Context
+	cancelHashes context.CancelFunc
+	// workerPool bounds the concurrent hash computations, nil computes every
+	// hash on its own goroutine.
+	workerPool  *hashWorkerPool
+	idempotency *idempotencyCache
+	// dedup is set with -dedup, identical inputs then share an id.
+	dedup *dedupIndex
+	// readTimeout and uploadTimeout bound the reads of a streamed body, see
+	// createStreamedHash.
+	readTimeout   time.Duration
+	uploadTimeout time.Duration
+	// maxUploadBytes limits the size of a streamed body.
+	maxUploadBytes int64
+	// uuids is set with -id-format=uuid, the ids are then shown as UUIDs.
+	uuids *uuidCodec
+	// jsonResponses is set with -response-style=json, the ids are then
+	// returned with the status of their hashes.
+	jsonResponses bool
+	// progress tracks the streamed bodies that are being read.
+	progress progressTracker
 
 	hashRequestProcessingDurationsMutex sync.Mutex
-	hashRequestProcessingDurations      []int64
+	// hashRequestProcessingDurations holds the last statsSampleSize durations,
+	// the percentiles are computed over them. nextDuration is the index the
+	// next duration overwrites once it is full.
+	hashRequestProcessingDurations []int64
+	nextDuration                   int
+	// requestHistogram buckets all the durations.
+	requestHistogram               statsHistogram
+	hashRequestCount               int64
+	hashRequestProcessingTimeTotal int64
+	hashRequestProcessingTimeMin   int64
+	hashRequestProcessingTimeMax   int64
+	// algorithmStats holds the request count and total processing time per algorithm.
+	algorithmStats map[string]*algorithmStats
+	// hashComputeCount and hashComputeTimeTotal track the time spent computing the
+	// hashes, which happens after the request has been handled.
+	hashComputeCount     int64
+	hashComputeTimeTotal int64
+	// bytesIn and bytesOut are the password bytes received and the response
+	// bytes written by the /hash handlers.
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+
+	processingDurationHistogram *histogram
 }
 
-var gracefulShutdownRequestChan = make(chan bool, 1)
+// testRoutes are extra routes registered only by test builds.
+var testRoutes = map[string]http.HandlerFunc{}
+
+// hashServer is a running instance of the service: one http.Server per
+// listen address and the shutdown state they share.
+type hashServer struct {
+	logger               *log.Logger
+	store                *hashStore
+	servers              []*http.Server
+	shutdownTimeout      time.Duration
+	abandonPendingHashes bool
+
+	// shutdownRequest is closed, once, to start the graceful shutdown.
+	shutdownRequest     chan struct{}
+	shutdownRequestOnce sync.Once
+	shutdownInProgress  atomic.Bool
+	ready               atomic.Bool
+	// draining is set by POST /drain or SIGUSR1, new hashes are then refused.
+	draining atomic.Bool
+	// shutdownComplete is closed once the shutdown is done.
+	shutdownComplete chan struct{}
+}
 
 func main() {
-	var listenAddr string
-	flag.StringVar(&listenAddr, "listen-addr", defaultServerListenAddr, "server listen address")
-	flag.Parse()
+	config, err := loadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatalf("Invalid config: %v\n", err)
+	}
 
-	logger := log.New(os.Stdout, "http: ", log.LstdFlags)
+	logger, err := newLogger(config.LogFormat, config.LogLevel)
+	if err != nil {
+		log.Fatalf("Could not create the logger: %v\n", err)
+	}
 
-	serverShutdownComplete := make(chan bool, 1)
+	hashConfig := config.hashConfig()
+	if config.WriteTimeout > 0 && hashConfig.maxWait() >= config.WriteTimeout {
+		logger.Printf("-max-wait %v is not shorter than -write-timeout %v, GET /hash/<id>?wait=true may be cut off\n", hashConfig.maxWait(), config.WriteTimeout)
+	}
 
-	hashStore := hashStore{
-		hashedDataCounter:              0,
-		hashedData:                     make(map[int]string),
-		hashRequestProcessingDurations: make([]int64, 0, 100),
+	shutdownTracing, err := initTracing()
+	if err != nil {
+		logger.Fatalf("Could not initialize tracing: %v\n", err)
 	}
-	server := initHashServer(logger, &hashStore, listenAddr)
-	go gracefulShutdown(server, logger, gracefulShutdownRequestChan, serverShutdownComplete)
 
-	logger.Println("Server is ready to handle requests at", listenAddr)
-	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		logger.Fatalf("Could not listen on %s: %v\n", listenAddr, err)
+	var pepper []byte
+	if config.PepperFile != "" {
+		pepper, err = os.ReadFile(config.PepperFile)
+		if err != nil {
+			logger.Fatalf("Could not read the pepper file: %v\n", err)
+		}
+		pepper = bytes.TrimRight(pepper, "\r\n")
+		if len(pepper) == 0 {
+			logger.Fatalf("Could not read the pepper file: %s is empty\n", config.PepperFile)
+		}
+		if len(pepper) >= maxBcryptInputBytes {
+			logger.Fatalf("Could not use the pepper file: %s leaves no room for bcrypt passwords, it must be shorter than %d bytes\n", config.PepperFile, maxBcryptInputBytes)
+		}
 	}
 
-	<-serverShutdownComplete
+	var idKey []byte
+	if config.IDFormat == uuidIDFormat && config.IDKeyFile != "" {
+		idKey, err = os.ReadFile(config.IDKeyFile)
+		if err != nil {
+			logger.Fatalf("Could not read the id key file: %v\n", err)
+		}
+		idKey = bytes.TrimRight(idKey, "\r\n")
+		if len(idKey) < minIDKeyBytes {
+			logger.Fatalf("Could not use the id key file: %s must hold at least %d bytes\n", config.IDKeyFile, minIDKeyBytes)
+		}
+	}
+
+	storage, err := openStorage(config.DataFile, config.DBPath, config.RedisAddr, config.MaxHashes, config.HashShards)
+	if err != nil {
+		logger.Fatalf("Could not open the hash storage: %v\n", err)
+	}
+
+	hashStore := newHashStore(config, storage, pepper, idKey)
+	if config.ConfigPath != "" {
+		hashStore.reloadConfigOnSignal(logger)
+	}
+	if config.HashTTL > 0 {
+		go hashStore.sweepExpiredHashes(hashStore.stopSweeper)
+	}
+
+	var limiter *rateLimiter
+	if config.RateLimit > 0 {
+		limiter = newRateLimiter(config.RateLimit, config.RateBurst)
+	}
+
+	network, listenAddrs := "tcp", strings.Split(config.ListenAddr, ",")
+	if config.UnixSocket != "" {
+		network, listenAddrs = "unix", []string{config.UnixSocket}
+	}
+
+	server := initHashServer(logger, hashStore, config, listenAddrs, limiter)
+	listeners := make([]net.Listener, len(server.servers))
+	connSlots := newConnSlots(config.MaxConns)
+	for i, httpServer := range server.servers {
+		listeners[i], err = listen(network, httpServer.Addr)
+		if err != nil {
+			logger.Fatalf("Could not listen on %s: %v\n", httpServer.Addr, err)
+		}
+		if connSlots != nil {
+			listeners[i] = newLimitListener(listeners[i], connSlots)
+		}
+	}
+	server.shutdownOnSignal()
+	server.drainOnSignal()
+	go server.gracefulShutdown()
+
+	server.ready.Store(true)
+	for i, httpServer := range server.servers {
+		go serve(logger, httpServer, listeners[i], config.TLSCert, config.TLSKey)
+	}
+
+	<-server.shutdownComplete
+	if err := shutdownTracing(context.Background()); err != nil {
+		logger.Printf("Could not flush the traces: %v\n", err)
+	}
 	logger.Println("Server stopped")
 }
 
-func initHashServer(logger *log.Logger, store *hashStore, listenAddr string) *http.Server {
+// newHashStore returns the hash store for the config, keeping the hashes in
+// storage. The pepper and the id key are read from -pepper-file and
+// -id-key-file by the caller.
+func newHashStore(config *Config, storage Storage, pepper, idKey []byte) *hashStore {
+	hs := &hashStore{
+		startTime:                      time.Now(),
+		hmacKey:                        []byte(config.HMACKey),
+		pepper:                         pepper,
+		jsonResponses:                  config.ResponseStyle == jsonResponseStyle,
+		storage:                        storage,
+		hashTTL:                        config.HashTTL,
+		readTimeout:                    config.ReadTimeout,
+		uploadTimeout:                  config.UploadTimeout,
+		maxUploadBytes:                 config.MaxUploadBytes,
+		stopSweeper:                    make(chan struct{}),
+		pendingHashes:                  make(map[int]chan struct{}),
+		pendingReadyAt:                 make(map[int]time.Time),
+		hashRequestProcessingDurations: make([]int64, 0, statsSampleSize),
+		requestHistogram:               newStatsHistogram(statsHistogramBounds),
+		algorithmStats:                 make(map[string]*algorithmStats),
+		processingDurationHistogram:    newHistogram(processingDurationBuckets),
+	}
+
+	hashConfig := config.hashConfig()
+	hs.config.Store(&hashConfig)
+	hs.idempotency = newIdempotencyCache(config.IdempotencyTTL)
+	if config.Dedup {
+		hs.dedup = newDedupIndex()
+	}
+	if config.IDFormat == uuidIDFormat {
+		hs.uuids = newUUIDCodec(idKey)
+	}
+	hs.hashCtx, hs.cancelHashes = context.WithCancel(context.Background())
+	if config.HashWorkers > 0 {
+		hs.workerPool = newHashWorkerPool(config.HashWorkers, config.HashQueueSize)
+	}
+	return hs
+}
+
+// listen listens on a TCP address or a unix socket. A socket file left behind
+// by a previous run is removed first; the listener removes it again when it is
+// closed on shutdown.
+func listen(network, addr string) (net.Listener, error) {
+	if network == "unix" {
+		if info, err := os.Stat(addr); err == nil && info.Mode()&os.ModeSocket != 0 {
+			if err := os.Remove(addr); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return net.Listen(network, addr)
+}
+
+// serve handles requests on the listener until the server is shut down.
+func serve(logger *log.Logger, server *http.Server, listener net.Listener, tlsCert, tlsKey string) {
+	var err error
+	if tlsCert != "" {
+		logger.Println("Server is ready to handle HTTPS requests at", listener.Addr())
+		err = server.ServeTLS(listener, tlsCert, tlsKey)
+	} else {
+		logger.Println("Server is ready to handle requests at", listener.Addr())
+		err = server.Serve(listener)
+	}
+	if err != nil && err != http.ErrServerClosed {
+		logger.Fatalf("Could not serve on %s: %v\n", listener.Addr(), err)
+	}
+}
+
+// initHashServer returns a server with one http.Server per listen address,
+// all sharing the same handler and hash store.
+func initHashServer(logger *log.Logger, store *hashStore, config *Config, listenAddrs []string, limiter *rateLimiter) *hashServer {
+	srv := &hashServer{
+		logger:               logger,
+		store:                store,
+		shutdownTimeout:      config.ShutdownTimeout,
+		abandonPendingHashes: config.AbandonPendingHashes,
+		shutdownRequest:      make(chan struct{}),
+		shutdownComplete:     make(chan struct{}),
+	}
 	router := http.NewServeMux()
 
-	router.HandleFunc("/hash", store.hash)
-	router.HandleFunc("/hash/", store.hash)
-	router.HandleFunc("/stats", store.stats)
-	router.HandleFunc("/shutdown", shutdown)
+	router.HandleFunc("/hash", srv.refuseWhileDraining(rateLimited(limiter, store.hash)))
+	router.HandleFunc("/hash/", srv.refuseWhileDraining(rateLimited(limiter, store.hash)))
+	router.HandleFunc("/verify/", rateLimited(limiter, store.verify))
+	router.HandleFunc("/digest", rateLimited(limiter, store.digestPassword))
+	// A configured token replaces the loopback restriction.
+	protect := loopbackOnly
+	switch {
+	case config.ShutdownToken != "":
+		protect = func(next http.HandlerFunc) http.HandlerFunc {
+			return requireToken(config.ShutdownToken, next)
+		}
+	case config.AllowRemoteShutdown:
+		protect = func(next http.HandlerFunc) http.HandlerFunc { return next }
+	}
+	// The listing and the totals would give away the number of hashes the
+	// UUIDs hide, they get the same protection as /shutdown.
+	counting := func(next http.HandlerFunc) http.HandlerFunc { return next }
+	if store.uuids != nil {
+		counting = protect
+	}
+	router.HandleFunc("/hashes", counting(store.listHashes))
+	router.HandleFunc("/count", counting(store.count))
+	router.HandleFunc("/stats", counting(store.stats))
+	router.HandleFunc("/metrics", counting(store.metrics))
+	router.HandleFunc("/version", versionInfo)
+	router.HandleFunc("/openapi.json", openAPI)
+	router.HandleFunc("/debug/memstats", debugMemStats)
+	router.HandleFunc("/healthz", srv.healthz)
+	router.HandleFunc("/readyz", srv.readyz)
+	router.HandleFunc("/stats/reset", store.resetStats)
+	router.HandleFunc("/shutdown", protect(srv.shutdown))
+	router.HandleFunc("/drain", protect(srv.drain))
+
+	router.HandleFunc("/", notFound)
+	for pattern, handler := range testRoutes {
+		router.HandleFunc(pattern, handler)
+	}
+
+	// The routes are served under the /v1 API version prefix and, for backward
+	// compatibility, unprefixed.
+	versioned := http.NewServeMux()
+	versioned.Handle("/", router)
+	versioned.Handle(apiV1Prefix+"/", http.StripPrefix(apiV1Prefix, router))
+
+	// Behind a reverse proxy the routes can be served under a base path,
+	// which is stripped before routing so the handlers see the same paths.
+	var routes http.Handler = versioned
+	if basePath := strings.TrimSuffix(config.BasePath, "/"); basePath != "" {
+		based := http.NewServeMux()
+		based.Handle(basePath+"/", http.StripPrefix(basePath, versioned))
+		based.HandleFunc("/", notFound)
+		routes = based
+	}
 
-	return &http.Server{
-		Addr:     listenAddr,
-		Handler:  router,
-		ErrorLog: logger,
+	// With -h2c HTTP/2 is accepted without TLS, next to HTTP/1.1. Shutdown
+	// closes the HTTP/2 connections gracefully like the HTTP/1.1 ones.
+	var protocols *http.Protocols
+	if config.H2C {
+		protocols = new(http.Protocols)
+		protocols.SetHTTP1(true)
+		protocols.SetHTTP2(true)
+		protocols.SetUnencryptedHTTP2(true)
 	}
+
+	handler := traceHandler(withRequestID(accessLog(recoverPanics(withGzip(withCORS(parseOrigins(config.CORSOrigins), routes))))))
+	for _, listenAddr := range listenAddrs {
+		srv.servers = append(srv.servers, &http.Server{
+			Addr:         strings.TrimSpace(listenAddr),
+			Handler:      handler,
+			ErrorLog:     logger,
+			ReadTimeout:  config.ReadTimeout,
+			WriteTimeout: config.WriteTimeout,
+			IdleTimeout:  config.IdleTimeout,
+			Protocols:    protocols,
+		})
+	}
+	return srv
 }
 
 func (hs *hashStore) hash(w http.ResponseWriter, r *http.Request) {
-	if r.Method == "GET" {
-		idStr := strings.TrimPrefix(r.URL.Path, "/hash/")
-		if idStr != "" {
-			id, err := strconv.Atoi(idStr)
-			if err != nil {
-				http.Error(w, "Invalid hash id.", httpBadRequest)
-			} else {
-				hs.hashedDataMutex.Lock()
-				if id <= hs.hashedDataCounter && id >= 1 {
-					if val, ok := hs.hashedData[id]; ok {
-						fmt.Fprintf(w, val)
-					} else {
-						http.Error(w, "Hash not generated yet.", httpBadRequest)
-					}
-				} else {
-					http.Error(w, "Index out of range.", httpBadRequest)
+	w = &byteCounter{ResponseWriter: w, count: &hs.bytesOut}
+	switch r.Method {
+	case http.MethodGet:
+		if strings.HasSuffix(r.URL.Path, "/events") {
+			hs.hashEvents(w, r)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/progress") {
+			hs.hashProgress(w, r)
+			return
+		}
+		hs.getHash(w, r)
+	case http.MethodPost:
+		hs.createHash(w, r)
+	case http.MethodDelete:
+		hs.deleteHash(w, r)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		writeJSONError(w, httpMethodNotAllowed, "Method not allowed.")
+	}
+}
+
+// byteCounter adds the number of response bytes written to count.
+type byteCounter struct {
+	http.ResponseWriter
+	count *atomic.Int64
+}
+
+func (bc *byteCounter) Write(b []byte) (int, error) {
+	n, err := bc.ResponseWriter.Write(b)
+	bc.count.Add(int64(n))
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (bc *byteCounter) Unwrap() http.ResponseWriter {
+	return bc.ResponseWriter
+}
+
+// deleteHash removes a stored hash. Ids are never reused, so the counter is
+// left untouched.
+func (hs *hashStore) deleteHash(w http.ResponseWriter, r *http.Request) {
+	id, err := hs.parseID(strings.TrimPrefix(r.URL.Path, "/hash/"))
+	if err != nil {
+		writeJSONError(w, httpBadRequest, "Invalid hash id.")
+		return
+	}
+
+	hs.pendingHashesMutex.Lock()
+	_, pending := hs.pendingHashes[id]
+	hs.pendingHashesMutex.Unlock()
+	if pending {
+		writeJSONError(w, httpConflict, "Hash is still being computed.")
+		return
+	}
+
+	deleted, err := hs.storage.Delete(id)
+	if err != nil {
+		log.Printf("request %s: unable to delete hash id %d: %v", requestIDFromContext(r.Context()), id, err)
+		writeJSONError(w, httpInternalServerError, "Internal server error.")
+		return
+	}
+	if !deleted {
+		writeJSONError(w, httpNotFound, "Hash not found.")
+		return
+	}
+	if hs.dedup != nil {
+		hs.dedup.forget(id)
+	}
+	w.WriteHeader(httpNoContent)
+}
+
+func (hs *hashStore) getHash(w http.ResponseWriter, r *http.Request) {
+	idStr := strings.TrimPrefix(r.URL.Path, "/hash/")
+	if idStr == "" {
+		writeJSONError(w, httpBadRequest, "Missing hash id parameter.")
+		return
+	}
+
+	id, err := hs.parseID(idStr)
+	if err != nil {
+		writeJSONError(w, httpBadRequest, "Invalid hash id.")
+		return
+	}
+
+	lastID, err := hs.storage.LastID()
+	if err != nil {
+		log.Printf("request %s: unable to get the last hash id: %v", requestIDFromContext(r.Context()), err)
+		writeJSONError(w, httpInternalServerError, "Internal server error.")
+		return
+	}
+	// A well-formed id that was never assigned is a missing resource.
+	if id > lastID || id < 1 {
+		writeJSONError(w, httpNotFound, "Hash not found.")
+		return
+	}
+
+	hs.pendingHashesMutex.Lock()
+	hashComputed, pending := hs.pendingHashes[id]
+	hs.pendingHashesMutex.Unlock()
+
+	if pending {
+		if r.URL.Query().Get("wait") != "true" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(httpAccepted)
+			writeString(w, r, `{"status":"pending"}`+"\n")
+			return
+		}
+
+		err := hs.waitForHash(r.Context(), hashComputed)
+		if errors.Is(err, errHashWaitTimeout) {
+			writeJSONError(w, httpGatewayTimeout, "Timed out waiting for the hash.")
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	entry, ok, err := hs.storage.Get(id)
+	if err != nil {
+		log.Printf("request %s: unable to get hash id %d: %v", requestIDFromContext(r.Context()), id, err)
+		writeJSONError(w, httpInternalServerError, "Internal server error.")
+		return
+	}
+	if !ok || hs.isExpired(entry) {
+		writeJSONError(w, httpNotFound, "Hash not found.")
+		return
+	}
+
+	writeText(w, r, entry.String())
+}
+
+func (hs *hashStore) createHash(w http.ResponseWriter, r *http.Request) {
+	// Every password of a batch is counted as a separate request.
+	start := time.Now()
+	numPasswords := 1
+	algorithm := ""
+	defer func() {
+		hs.storeHashRequestProcessingDuration(start, numPasswords, algorithm)
+	}()
+
+	config := hs.config.Load()
+	algorithm, encoding, ok := requestAlgorithmAndEncoding(w, r, config)
+	if !ok {
+		return
+	}
+
+	if callbackURL := r.URL.Query().Get("callback_url"); callbackURL != "" && !validCallbackURL(callbackURL) {
+		writeJSONError(w, httpBadRequest, "Invalid callback_url, a public http or https URL is required.")
+		return
+	}
+
+	if isStreamRequest(r) {
+		hs.createStreamedHash(w, r, algorithm, encoding)
+		return
+	}
+
+	jsonRequest := isJSONRequest(r)
+	passwords, err := readPasswords(w, r)
+	if errors.Is(err, errMalformedJSON) {
+		writeJSONError(w, httpBadRequest, "Malformed JSON body.")
+		return
+	}
+	if errors.Is(err, errRequestTooLarge) {
+		writeJSONError(w, httpBadRequest, "Request body too large.")
+		return
+	}
+	if err != nil {
+		log.Printf("request %s: unable to parse form: %v", requestIDFromContext(r.Context()), err)
+		writeJSONError(w, httpBadRequest, "Malformed form body.")
+		return
+	}
+
+	if len(passwords) == 0 || slices.Contains(passwords, "") {
+		writeJSONError(w, httpBadRequest, "Password is required.")
+		return
+	}
+	for _, password := range passwords {
+		if len(password) > config.maxPasswordBytes {
+			writeJSONError(w, httpBadRequest, fmt.Sprintf("Password is longer than %d bytes.", config.maxPasswordBytes))
+			return
+		}
+		if algorithm == bcryptAlgorithm && len(password) > hs.maxBcryptPasswordBytes() {
+			writeJSONError(w, httpBadRequest, fmt.Sprintf("Password is longer than %d bytes, the bcrypt limit.", hs.maxBcryptPasswordBytes()))
+			return
+		}
+	}
+	numPasswords = len(passwords)
+	for _, password := range passwords {
+		hs.bytesIn.Add(int64(len(password)))
+	}
+
+	spanCtx := hashContext(r)
+	schedule := func() ([]int, error) {
+		return hs.scheduleHashes(spanCtx, passwords, algorithm, encoding)
+	}
+	var digest string
+	if r.Header.Get(idempotencyKeyHeader) != "" {
+		parts := make([][]byte, len(passwords))
+		for i, password := range passwords {
+			parts[i] = []byte(password)
+		}
+		digest = requestDigest(r, parts...)
+	}
+	hs.scheduleAndRespond(w, r, jsonRequest, digest, schedule)
+}
+
+// requestAlgorithmAndEncoding returns the ?algorithm= and ?encoding= of the
+// request, or their defaults. Unsupported values are rejected with a 400.
+func requestAlgorithmAndEncoding(w http.ResponseWriter, r *http.Request, config *hashConfig) (string, string, bool) {
+	algorithm := r.URL.Query().Get("algorithm")
+	if algorithm == "" {
+		algorithm = config.hashAlgorithm
+	}
+	if !isSupportedHashAlgorithm(algorithm) {
+		writeJSONError(w, httpBadRequest, "Unsupported hash algorithm.")
+		return "", "", false
+	}
+
+	encoding := r.URL.Query().Get("encoding")
+	if encoding == "" {
+		encoding = defaultEncoding
+	}
+	if _, ok := encodings[encoding]; !ok {
+		writeJSONError(w, httpBadRequest, "Unsupported encoding.")
+		return "", "", false
+	}
+	return algorithm, encoding, true
+}
+
+// scheduleAndRespond runs schedule, once per Idempotency-Key, and writes the
+// scheduled ids. With ?sync=true or a zero hash delay it writes the computed
+// hashes along with their ids instead. A single id is written as plain text,
+// a batch as a JSON array and the id of a JSON request as a JSON object.
+// digest is the requestDigest the Idempotency-Key is bound to.
+func (hs *hashStore) scheduleAndRespond(w http.ResponseWriter, r *http.Request, jsonRequest bool, digest string, schedule func() ([]int, error)) {
+	var hashIds []int
+	var err error
+	if key := r.Header.Get(idempotencyKeyHeader); key != "" {
+		hashIds, err = hs.idempotency.do(key, digest, schedule)
+	} else {
+		hashIds, err = schedule()
+	}
+	if errors.Is(err, errIdempotencyKeyReused) {
+		writeJSONError(w, httpUnprocessableEntity, "Idempotency-Key was already used for a different request.")
+		return
+	}
+	if errors.Is(err, errHashQueueFull) {
+		w.Header().Set("Retry-After", "1")
+		writeJSONError(w, httpServiceUnavailable, "Too many pending hashes, try again later.")
+		return
+	}
+	if err != nil {
+		log.Printf("request %s: unable to allocate a hash id: %v", requestIDFromContext(r.Context()), err)
+		writeJSONError(w, httpInternalServerError, "Internal server error.")
+		return
+	}
+
+	if r.URL.Query().Get("sync") == "true" {
+		hs.respondWithHashes(w, r, jsonRequest, hashIds)
+		return
+	}
+	// Without a hash delay the hashes are computed while the request is
+	// handled, unless they are queued for the worker pool.
+	if hs.config.Load().hashDelay == 0 && hs.workerPool == nil {
+		hs.respondWithIDsAndHashes(w, r, hashIds)
+		return
+	}
+
+	var response interface{}
+	switch {
+	case hs.jsonResponses && len(hashIds) > 1:
+		response = hs.pendingIDs(hashIds)
+	case hs.jsonResponses:
+		response = hs.pendingIDs(hashIds)[0]
+	case jsonRequest:
+		response = map[string]interface{}{"id": hs.jsonID(hashIds[0])}
+	case len(hashIds) > 1:
+		response = hs.jsonIDs(hashIds)
+	default:
+		writeText(w, r, hs.formatID(hashIds[0]))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpOK)
+	err = json.NewEncoder(w).Encode(response)
+	logWriteError(r, err)
+}
+
+// pendingID is an id returned with -response-style=json.
+type pendingID struct {
+	ID      interface{} `json:"id"`
+	Status  string      `json:"status"`
+	ReadyAt *time.Time  `json:"ready_at,omitempty"`
+}
+
+// pendingIDs returns the ids along with the status of their hashes. A pending
+// hash is estimated to be ready once the hash delay has passed since it was
+// reserved, a full worker pool queue can delay it further.
+func (hs *hashStore) pendingIDs(hashIds []int) []pendingID {
+	ids := make([]pendingID, len(hashIds))
+
+	hs.pendingHashesMutex.Lock()
+	defer hs.pendingHashesMutex.Unlock()
+	for i, id := range hashIds {
+		ids[i] = pendingID{ID: hs.jsonID(id), Status: "computed"}
+		// An earlier request with the same Idempotency-Key or, with -dedup,
+		// the same password can already have been computed.
+		if readyAt, pending := hs.pendingReadyAt[id]; pending {
+			readyAt = readyAt.UTC()
+			ids[i].Status = "pending"
+			ids[i].ReadyAt = &readyAt
+		}
+	}
+	return ids
+}
+
+var errMalformedJSON = errors.New("malformed JSON body")
+var errRequestTooLarge = errors.New("request body too large")
+
+// readPasswords returns the passwords sent as form fields or, for JSON
+// requests, the password field of the JSON body. Bodies larger than
+// maxRequestBodyBytes are rejected without being buffered.
+func readPasswords(w http.ResponseWriter, r *http.Request) ([]string, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodyBytes)
+	var maxBytesErr *http.MaxBytesError
+
+	if isJSONRequest(r) {
+		var body struct {
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			if errors.As(err, &maxBytesErr) {
+				return nil, errRequestTooLarge
+			}
+			return nil, errMalformedJSON
+		}
+		return []string{body.Password}, nil
+	}
+
+	if err := r.ParseForm(); err != nil {
+		if errors.As(err, &maxBytesErr) {
+			return nil, errRequestTooLarge
+		}
+		return nil, err
+	}
+	return r.Form["password"], nil
+}
+
+func isJSONRequest(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+// scheduleHashes allocates an id for every password and schedules the
+// computation of their hashes. With -dedup an identical input gets the id of
+// the existing hash. All the ids are reserved before any hash is scheduled, if
+// one can't be, e.g. errHashQueueFull with a full worker pool queue, none of
+// the hashes is scheduled.
+func (hs *hashStore) scheduleHashes(ctx context.Context, passwords []string, algorithm, encoding string) ([]int, error) {
+	hashIds := make([]int, len(passwords))
+	reserved := make([]bool, len(passwords))
+	for i, password := range passwords {
+		var err error
+		hashIds[i], reserved[i], err = hs.reservePasswordHash([]byte(password), algorithm, encoding)
+		if err != nil {
+			for j := range i {
+				if reserved[j] {
+					hs.abandonPasswordHash(hashIds[j])
 				}
-				hs.hashedDataMutex.Unlock()
 			}
+			return nil, err
+		}
+	}
+
+	for i, password := range passwords {
+		if reserved[i] {
+			hs.scheduleReservedHash(ctx, hashIds[i], func() (hashedEntry, error) {
+				return hs.computeHash([]byte(password), algorithm, encoding)
+			})
+		}
+	}
+	return hashIds, nil
+}
+
+// reservePasswordHash reserves an id for the hash of password. With -dedup
+// the id of an existing hash of the same input is returned instead, reserved
+// is then false.
+func (hs *hashStore) reservePasswordHash(password []byte, algorithm, encoding string) (hashId int, reserved bool, err error) {
+	if hs.dedup != nil {
+		return hs.reserveDedupedHash(password, algorithm, encoding)
+	}
+	hashId, err = hs.reserveHash()
+	return hashId, err == nil, err
+}
+
+// abandonPasswordHash gives up an id reserved by reservePasswordHash.
+func (hs *hashStore) abandonPasswordHash(hashId int) {
+	if hs.dedup != nil {
+		hs.dedup.forget(hashId)
+	}
+	hs.abandonHash(hashId)
+}
+
+// reserveHash allocates a new id, and a worker pool slot, and registers the
+// hash as pending. The id must then be passed to either scheduleReservedHash
+// or abandonHash.
+func (hs *hashStore) reserveHash() (int, error) {
+	if hs.workerPool != nil && !hs.workerPool.reserve() {
+		return 0, errHashQueueFull
+	}
+	hashId, err := hs.storage.NextID()
+	if err != nil {
+		if hs.workerPool != nil {
+			hs.workerPool.release()
+		}
+		return 0, err
+	}
+	hs.pendingHashesMutex.Lock()
+	hs.pendingHashes[hashId] = make(chan struct{})
+	hs.pendingReadyAt[hashId] = time.Now().Add(hs.config.Load().hashDelay)
+	hs.pendingHashesWaitGroup.Add(1)
+	hs.pendingHashesMutex.Unlock()
+	return hashId, nil
+}
+
+// abandonHash gives up a reserved hash without computing it.
+func (hs *hashStore) abandonHash(hashId int) {
+	if hs.workerPool != nil {
+		hs.workerPool.release()
+	}
+	hs.finishHash(hashId)
+}
+
+// scheduleReservedHash schedules compute for a reserved id.
+func (hs *hashStore) scheduleReservedHash(ctx context.Context, hashId int, compute func() (hashedEntry, error)) {
+	hashFunc := hs.hashAndEncode(ctx, compute, hashId)
+	if hs.workerPool != nil {
+		hashFunc = hs.workerPool.queue(hashFunc)
+	}
+	hashDelay := hs.config.Load().hashDelay
+	if hashDelay == 0 || skipHashDelay(ctx) {
+		hashFunc()
+		return
+	}
 
+	// A hash whose delay hasn't passed when the hash context is cancelled is
+	// abandoned right away instead of waiting for its timer. The timer exists
+	// before the abandon func is registered, which may run at once, and waits
+	// for the registration before it unregisters it.
+	var stopAbandon func() bool
+	registered := make(chan struct{})
+	timer := time.AfterFunc(hashDelay, func() {
+		<-registered
+		stopAbandon()
+		hashFunc()
+	})
+	stopAbandon = context.AfterFunc(hs.hashCtx, func() {
+		if timer.Stop() {
+			hs.abandonHash(hashId)
+		}
+	})
+	close(registered)
+}
+
+// verify checks whether a candidate password matches the hash stored for an
+// id without returning the hash itself.
+func (hs *hashStore) verify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeJSONError(w, httpMethodNotAllowed, "Method not allowed.")
+		return
+	}
+
+	id, err := hs.parseID(strings.TrimPrefix(r.URL.Path, "/verify/"))
+	if err != nil {
+		writeJSONError(w, httpBadRequest, "Invalid hash id.")
+		return
+	}
+
+	passwords, err := readPasswords(w, r)
+	if err != nil || len(passwords) != 1 || passwords[0] == "" || len(passwords[0]) > hs.config.Load().maxPasswordBytes {
+		writeJSONError(w, httpBadRequest, "A single password is required.")
+		return
+	}
+
+	hs.pendingHashesMutex.Lock()
+	_, pending := hs.pendingHashes[id]
+	hs.pendingHashesMutex.Unlock()
+	if pending {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(httpAccepted)
+		writeString(w, r, `{"status":"pending"}`+"\n")
+		return
+	}
+
+	entry, ok, err := hs.storage.Get(id)
+	if err != nil {
+		log.Printf("request %s: unable to get hash id %d: %v", requestIDFromContext(r.Context()), id, err)
+		writeJSONError(w, httpInternalServerError, "Internal server error.")
+		return
+	}
+	if !ok || hs.isExpired(entry) {
+		writeJSONError(w, httpNotFound, "Hash not found.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(map[string]bool{"match": hs.matches(entry, []byte(passwords[0]))})
+	logWriteError(r, err)
+}
+
+// listHashes returns the ids of all hashes that have been computed, in ascending order.
+// With -id-format=uuid the UUIDs are sorted instead, so that the listing doesn't
+// show the order the hashes were created in. Hashes that are still pending are not
+// included. With ?limit= or ?after= a page of the ids is returned along with the
+// cursor of the next page.
+func (hs *hashStore) listHashes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeJSONError(w, httpMethodNotAllowed, "Method not allowed.")
+		return
+	}
+
+	query := r.URL.Query()
+	paginated := query.Has("limit") || query.Has("after")
+	limit := defaultHashesPageLimit
+	if query.Has("limit") {
+		var err error
+		limit, err = strconv.Atoi(query.Get("limit"))
+		if err != nil || limit < 1 {
+			writeJSONError(w, httpBadRequest, "Invalid limit.")
 			return
+		}
+		limit = min(limit, maxHashesPageLimit)
+	}
+	after := 0
+	if query.Has("after") {
+		var err error
+		if hs.uuids != nil {
+			// Any version 4 UUID is a cursor, the listing is in UUID order.
+			_, err = hs.uuids.parse(query.Get("after"))
 		} else {
-			http.Error(w, "Missing hash id parameter.", httpBadRequest)
+			after, err = strconv.Atoi(query.Get("after"))
+		}
+		if err != nil || after < 0 {
+			writeJSONError(w, httpBadRequest, "Invalid after cursor.")
 			return
 		}
 	}
 
-	defer hs.storeHashRequestProcessingDuration(time.Now())
-
-	err := r.ParseForm()
+	ids, err := hs.storage.IDs()
 	if err != nil {
-		log.Printf("unable to parse form: %v", err)
+		log.Printf("request %s: unable to list hashes: %v", requestIDFromContext(r.Context()), err)
+		writeJSONError(w, httpInternalServerError, "Internal server error.")
 		return
 	}
 
-	password := []byte(r.Form.Get("password"))
-	hs.hashedDataMutex.Lock()
-	hs.hashedDataCounter += 1
-	hashId := hs.hashedDataCounter
-	hashFunc := hs.hashAndEncode(password, hashId)
-	hs.hashedDataMutex.Unlock()
-	time.AfterFunc(hashDelayIntervalSeconds*time.Second, hashFunc)
+	var response interface{} = ids
+	if hs.uuids != nil {
+		uuids := make([]string, len(ids))
+		for i, id := range ids {
+			uuids[i] = hs.uuids.format(id)
+		}
+		slices.Sort(uuids)
+		response = uuids
+		if paginated {
+			response = pageAfter(uuids, query.Get("after"), limit)
+		}
+	} else if paginated {
+		response = pageAfter(ids, after, limit)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(response)
+	logWriteError(r, err)
+}
 
-	fmt.Fprintf(w, "%v", hashId)
+// idsPage is a page of GET /hashes, Next is the cursor of the following page
+// or null on the last one.
+type idsPage[T cmp.Ordered] struct {
+	IDs  []T `json:"ids"`
+	Next *T  `json:"next"`
+}
+
+// pageAfter returns the page of at most limit of the sorted ids that starts
+// at the first id after the cursor.
+func pageAfter[T cmp.Ordered](ids []T, after T, limit int) idsPage[T] {
+	start, found := slices.BinarySearch(ids, after)
+	if found {
+		start++
+	}
+	page := idsPage[T]{IDs: ids[start:min(start+limit, len(ids))]}
+	if start+len(page.IDs) < len(ids) {
+		page.Next = &page.IDs[len(page.IDs)-1]
+	}
+	return page
 }
 
-func (hs *hashStore) hashAndEncode(data []byte, hashId int) func() {
+// count returns the number of accepted hash requests.
+func (hs *hashStore) count(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeJSONError(w, httpMethodNotAllowed, "Method not allowed.")
+		return
+	}
+
+	count, err := hs.storage.LastID()
+	if err != nil {
+		log.Printf("request %s: unable to get the last hash id: %v", requestIDFromContext(r.Context()), err)
+		writeJSONError(w, httpInternalServerError, "Internal server error.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(map[string]int{"count": count})
+	logWriteError(r, err)
+}
+
+// hashAndEncode returns the function that computes and stores the hash.
+func (hs *hashStore) hashAndEncode(ctx context.Context, compute func() (hashedEntry, error), hashId int) func() {
 	return func() {
-		h := sha256.New()
-		h.Write(data)
-		hash := h.Sum(nil)
+		defer hs.finishHash(hashId)
+		if hs.hashCtx.Err() != nil {
+			return
+		}
+		_, endSpan := startSpan(ctx, "hashAndEncode")
+		defer endSpan()
+
+		entry, err := compute()
+		if err == nil && hs.hashCtx.Err() == nil {
+			err = hs.storage.Put(hashId, entry)
+			if callbackURL := callbackURLFromContext(ctx); err == nil && callbackURL != "" {
+				go hs.notifyCallback(callbackURL, hashId, entry)
+			}
+		}
+		if err != nil {
+			log.Printf("unable to hash id %d: %v", hashId, err)
+		}
+	}
+}
+
+// finishHash marks the hash as no longer pending, whether it was stored or
+// abandoned.
+func (hs *hashStore) finishHash(hashId int) {
+	hs.pendingHashesMutex.Lock()
+	close(hs.pendingHashes[hashId])
+	delete(hs.pendingHashes, hashId)
+	delete(hs.pendingReadyAt, hashId)
+	hs.pendingHashesMutex.Unlock()
+	hs.progress.remove(hashId)
+	hs.pendingHashesWaitGroup.Done()
+}
+
+func (hs *hashStore) computeHash(data []byte, algorithm, encoding string) (hashedEntry, error) {
+	start := time.Now()
+	defer func() {
+		hs.storeHashComputeDuration(time.Since(start))
+	}()
+
+	entry := hashedEntry{
+		algorithm: algorithm,
+		encoding:  encoding,
+		createdAt: time.Now(),
+	}
+
+	if algorithm == bcryptAlgorithm {
+		// bcrypt output is already an encoded string($2a$...), store it as is.
+		hashed, err := bcrypt.GenerateFromPassword(hs.peppered(data), hs.config.Load().bcryptCost)
+		if err != nil {
+			return entry, err
+		}
+		entry.hash = string(hashed)
+		return entry, nil
+	}
+
+	var err error
+	entry.salt, err = newSalt()
+	if err != nil {
+		return entry, err
+	}
+	entry.hash = hs.digest(data, entry.salt, algorithm, encoding)
+	return entry, nil
+}
+
+func newSalt() ([]byte, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("unable to generate salt: %w", err)
+	}
+	return salt, nil
+}
+
+// digest returns the encoded digest of the salted and peppered data.
+func (hs *hashStore) digest(data, salt []byte, algorithm, encoding string) string {
+	h := hs.newHash(algorithm)
+	h.Write(salt)
+	h.Write(data)
+	h.Write(hs.pepper)
+	return encodings[encoding](h.Sum(nil))
+}
+
+// maxBcryptPasswordBytes is the longest password bcrypt can hash, the pepper
+// takes up part of its input.
+func (hs *hashStore) maxBcryptPasswordBytes() int {
+	return maxBcryptInputBytes - len(hs.pepper)
+}
+
+// peppered returns the password with the pepper appended.
+func (hs *hashStore) peppered(password []byte) []byte {
+	return append(slices.Clip(password), hs.pepper...)
+}
+
+// matches reports whether password produces the stored entry, using the
+// same algorithm, salt and encoding. The comparison is constant-time.
+func (hs *hashStore) matches(entry hashedEntry, password []byte) bool {
+	if entry.algorithm == bcryptAlgorithm {
+		return bcrypt.CompareHashAndPassword([]byte(entry.hash), hs.peppered(password)) == nil
+	}
+	candidate := hs.digest(password, entry.salt, entry.algorithm, entry.encoding)
+	return subtle.ConstantTimeCompare([]byte(candidate), []byte(entry.hash)) == 1
+}
 
-		hs.hashedDataMutex.Lock()
-		hs.hashedData[hashId] = base64.StdEncoding.EncodeToString(hash)
-		hs.hashedDataMutex.Unlock()
+// waitForPendingHashes blocks until all scheduled hashes are computed or ctx is done.
+func (hs *hashStore) waitForPendingHashes(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		hs.pendingHashesWaitGroup.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// newHash returns an HMAC of the given algorithm when a key is configured,
+// the plain digest otherwise.
+func (hs *hashStore) newHash(algorithm string) hash.Hash {
+	if len(hs.hmacKey) > 0 {
+		return hmac.New(hashAlgorithms[algorithm].New, hs.hmacKey)
 	}
+	return hashAlgorithms[algorithm].New()
 }
 
-func (hs *hashStore) storeHashRequestProcessingDuration(start time.Time) {
+// storeHashRequestProcessingDuration records a request that started at start and
+// contained numPasswords passwords. Each password is recorded as a separate request
+// with an equal share of the request processing time. Requests for a supported
+// algorithm are also recorded in that algorithm's stats.
+func (hs *hashStore) storeHashRequestProcessingDuration(start time.Time, numPasswords int, algorithm string) {
+	elapsed := time.Since(start) / time.Duration(numPasswords)
+
 	hs.hashRequestProcessingDurationsMutex.Lock()
-	duration := time.Since(start).Microseconds()
-	hs.hashRequestProcessingDurations = append(hs.hashRequestProcessingDurations, duration)
-	hs.hashRequestProcessingDurationsMutex.Unlock()
+	defer hs.hashRequestProcessingDurationsMutex.Unlock()
+	if isSupportedHashAlgorithm(algorithm) {
+		if hs.algorithmStats[algorithm] == nil {
+			hs.algorithmStats[algorithm] = &algorithmStats{}
+		}
+		hs.algorithmStats[algorithm].Total += int64(numPasswords)
+		hs.algorithmStats[algorithm].totalTime += elapsed.Microseconds() * int64(numPasswords)
+	}
+	for i := 0; i < numPasswords; i++ {
+		hs.processingDurationHistogram.observe(elapsed.Seconds())
+
+		duration := elapsed.Microseconds()
+		if len(hs.hashRequestProcessingDurations) < statsSampleSize {
+			hs.hashRequestProcessingDurations = append(hs.hashRequestProcessingDurations, duration)
+		} else {
+			hs.hashRequestProcessingDurations[hs.nextDuration] = duration
+			hs.nextDuration = (hs.nextDuration + 1) % statsSampleSize
+		}
+		hs.requestHistogram.observe(duration)
+		if hs.hashRequestCount == 0 || duration < hs.hashRequestProcessingTimeMin {
+			hs.hashRequestProcessingTimeMin = duration
+		}
+		if duration > hs.hashRequestProcessingTimeMax {
+			hs.hashRequestProcessingTimeMax = duration
+		}
+		hs.hashRequestCount++
+		hs.hashRequestProcessingTimeTotal += duration
+	}
 }
 
+// storeHashComputeDuration records the time it took to compute a single hash.
+func (hs *hashStore) storeHashComputeDuration(elapsed time.Duration) {
+	hs.hashRequestProcessingDurationsMutex.Lock()
+	defer hs.hashRequestProcessingDurationsMutex.Unlock()
+	hs.hashComputeCount++
+	hs.hashComputeTimeTotal += elapsed.Microseconds()
+}
+
+// algorithmStats are the /stats of a single hash algorithm.
+type algorithmStats struct {
+	Total     int64 `json:"total"`
+	Average   int64 `json:"average"`
+	totalTime int64
+}
+
+// percentile returns the nearest-rank percentile p of the sorted durations.
+func percentile(sorted []int64, p int) int64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// pendingCount returns the number of scheduled hashes that are not computed yet.
+func (hs *hashStore) pendingCount() int {
+	hs.pendingHashesMutex.Lock()
+	defer hs.pendingHashesMutex.Unlock()
+	return len(hs.pendingHashes)
+}
+
+// statsHistogramBounds are the upper bounds, in microseconds, of the /stats
+// processing duration histogram buckets.
+var statsHistogramBounds = []int64{100, 1000, 10000, 100000, 1000000}
+
+// statsSampleSize is the number of most recent durations the /stats
+// percentiles are computed over, so that a scrape costs the same however many
+// requests have been recorded.
+const statsSampleSize = 1000
+
+// statsHistogram is the /stats processing duration histogram. Counts[i] is the
+// number of durations in (Bounds[i-1], Bounds[i]], the last count is the number
+// of durations above the highest bound. Sum is the sum of all the durations.
+type statsHistogram struct {
+	Bounds []int64 `json:"bounds"`
+	Counts []int   `json:"counts"`
+	Sum    int64   `json:"sum"`
+}
+
+func newStatsHistogram(bounds []int64) statsHistogram {
+	return statsHistogram{Bounds: bounds, Counts: make([]int, len(bounds)+1)}
+}
+
+// observe adds a duration to its bucket.
+func (h *statsHistogram) observe(duration int64) {
+	i := 0
+	for i < len(h.Bounds) && duration > h.Bounds[i] {
+		i++
+	}
+	h.Counts[i]++
+	h.Sum += duration
+}
+
+// stats reports the hash request processing times. All durations are in microseconds.
+// The stats are returned as JSON, or in the Prometheus text exposition format when
+// the Accept header asks for text/plain, or as CSV with ?format=csv.
 func (hs *hashStore) stats(w http.ResponseWriter, r *http.Request) {
+	stats := hs.collectStats()
+
+	if r.URL.Query().Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="stats.csv"`)
+		err := writeStatsCSV(w, stats)
+		logWriteError(r, err)
+		return
+	}
+
+	w.Header().Add("Vary", "Accept")
+	if acceptsPrometheus(r.Header.Get("Accept")) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		ew := &errWriter{w: w}
+		writeStatsPrometheus(ew, stats)
+		logWriteError(r, ew.err)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(stats)
+	logWriteError(r, err)
+}
+
+// writeStatsCSV writes the stats as a header row of the sorted names followed by
+// a row of values. The histogram is written as one histogram_<bound> column per
+// bucket, plus histogram_inf for the durations above the highest bound and
+// histogram_sum, and the algorithm stats as algorithms_<algorithm>_total and
+// _average columns.
+func writeStatsCSV(w io.Writer, stats map[string]interface{}) error {
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var header, values []string
+	for _, name := range names {
+		switch value := stats[name].(type) {
+		case statsHistogram:
+			for i, bound := range value.Bounds {
+				header = append(header, name+"_"+strconv.FormatInt(bound, 10))
+				values = append(values, strconv.Itoa(value.Counts[i]))
+			}
+			header = append(header, name+"_inf", name+"_sum")
+			values = append(values, strconv.Itoa(value.Counts[len(value.Bounds)]), strconv.FormatInt(value.Sum, 10))
+		case map[string]algorithmStats:
+			for _, algorithm := range slices.Sorted(maps.Keys(value)) {
+				header = append(header, name+"_"+algorithm+"_total", name+"_"+algorithm+"_average")
+				values = append(values, strconv.FormatInt(value[algorithm].Total, 10), strconv.FormatInt(value[algorithm].Average, 10))
+			}
+		default:
+			header = append(header, name)
+			values = append(values, fmt.Sprint(value))
+		}
+	}
+
+	csvWriter := csv.NewWriter(w)
+	csvWriter.Write(header)
+	csvWriter.Write(values)
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
 
-	stats := make(map[string]int64)
+// collectStats returns the current /stats values keyed by name.
+func (hs *hashStore) collectStats() map[string]interface{} {
+	stats := make(map[string]interface{})
 
 	hs.hashRequestProcessingDurationsMutex.Lock()
-	numRequests := int64(len(hs.hashRequestProcessingDurations))
+	numRequests := hs.hashRequestCount
 	stats["total"] = numRequests
-	var totalProcessingTime int64
-	for i := 0; i < int(numRequests); i++ {
-		totalProcessingTime += hs.hashRequestProcessingDurations[i]
-	}
 	var average int64 = 0
 	if numRequests != 0 {
-		average = totalProcessingTime / numRequests
+		average = hs.hashRequestProcessingTimeTotal / numRequests
 	}
 	stats["average"] = average
+	stats["min"] = hs.hashRequestProcessingTimeMin
+	stats["max"] = hs.hashRequestProcessingTimeMax
+	sorted := slices.Clone(hs.hashRequestProcessingDurations)
+	slices.Sort(sorted)
+	stats["p50"] = percentile(sorted, 50)
+	stats["p90"] = percentile(sorted, 90)
+	stats["p99"] = percentile(sorted, 99)
+	stats["compute_total"] = hs.hashComputeCount
+	var computeAverage int64 = 0
+	if hs.hashComputeCount != 0 {
+		computeAverage = hs.hashComputeTimeTotal / hs.hashComputeCount
+	}
+	stats["compute_average"] = computeAverage
+	histogram := hs.requestHistogram
+	histogram.Counts = slices.Clone(histogram.Counts)
+	stats["histogram"] = histogram
+	algorithms := make(map[string]algorithmStats, len(hs.algorithmStats))
+	for algorithm, as := range hs.algorithmStats {
+		algorithms[algorithm] = algorithmStats{Total: as.Total, Average: as.totalTime / as.Total}
+	}
+	stats["algorithms"] = algorithms
 	hs.hashRequestProcessingDurationsMutex.Unlock()
 
-	err := json.NewEncoder(w).Encode(stats)
-	if err != nil {
-		log.Printf("failed to send json: %v", err)
+	uptimeSeconds := time.Since(hs.startTime).Seconds()
+	stats["uptime_seconds"] = uptimeSeconds
+	stats["pending"] = hs.pendingCount()
+	stats["bytes_in"] = hs.bytesIn.Load()
+	stats["bytes_out"] = hs.bytesOut.Load()
+
+	// Treat the first second as a whole second so that rates right after startup aren't inflated.
+	elapsedSeconds := uptimeSeconds
+	if elapsedSeconds < 1 {
+		elapsedSeconds = 1
 	}
+	stats["requests_per_second"] = float64(numRequests) / elapsedSeconds
+	return stats
+}
+
+// resetStats clears the accumulated processing time stats. The stored hashes are not affected.
+func (hs *hashStore) resetStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeJSONError(w, httpMethodNotAllowed, "Method not allowed.")
+		return
+	}
+
+	hs.hashRequestProcessingDurationsMutex.Lock()
+	hs.hashRequestProcessingDurations = hs.hashRequestProcessingDurations[:0]
+	hs.nextDuration = 0
+	hs.requestHistogram = newStatsHistogram(statsHistogramBounds)
+	hs.hashRequestCount = 0
+	hs.hashRequestProcessingTimeTotal = 0
+	hs.hashRequestProcessingTimeMin = 0
+	hs.hashRequestProcessingTimeMax = 0
+	clear(hs.algorithmStats)
+	hs.hashComputeCount = 0
+	hs.hashComputeTimeTotal = 0
+	hs.bytesIn.Store(0)
+	hs.bytesOut.Store(0)
+	hs.hashRequestProcessingDurationsMutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(map[string]string{"status": "reset"})
+	logWriteError(r, err)
 }
 
-func gracefulShutdown(server *http.Server, logger *log.Logger, gracefulShutdownRequestChan <-chan bool, serverShutdownComplete chan<- bool) {
-	<-gracefulShutdownRequestChan
+// gracefulShutdown waits for the shutdown request, then stops the servers,
+// waits for the pending hashes and closes the storage.
+func (srv *hashServer) gracefulShutdown() {
+	<-srv.shutdownRequest
+	logger, store := srv.logger, srv.store
 	logger.Println("Server is shutting down...")
+	srv.shutdownInProgress.Store(true)
+	srv.ready.Store(false)
 
-	ctx, cancel := context.WithTimeout(context.Background(), gracefulShutdownTimeout*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), srv.shutdownTimeout)
 	defer cancel()
 
-	server.SetKeepAlivesEnabled(false)
-	if err := server.Shutdown(ctx); err != nil {
-		logger.Fatalf("Could not gracefully shutdown the server: %v\n", err)
+	var serversShutdown sync.WaitGroup
+	for _, server := range srv.servers {
+		serversShutdown.Go(func() {
+			server.SetKeepAlivesEnabled(false)
+			if err := server.Shutdown(ctx); err != nil {
+				logger.Fatalf("Could not gracefully shutdown the server at %s: %v\n", server.Addr, err)
+			}
+		})
+	}
+	serversShutdown.Wait()
+
+	if !srv.abandonPendingHashes {
+		logger.Println("Waiting for pending hashes to be computed...")
+		if err := store.waitForPendingHashes(ctx); err != nil {
+			logger.Printf("Not all pending hashes were computed: %v\n", err)
+		}
+	}
+	// Abandon the hashes that are still pending and wait for the ones already
+	// being computed.
+	store.cancelHashes()
+	abandonCtx, cancelAbandon := context.WithTimeout(context.Background(), abandonedHashesWait)
+	defer cancelAbandon()
+	if err := store.waitForPendingHashes(abandonCtx); err != nil {
+		logger.Printf("Could not abandon the pending hashes: %v\n", err)
+	}
+	close(store.stopSweeper)
+	if err := store.storage.Close(); err != nil {
+		logger.Printf("Could not close the hash storage: %v\n", err)
+	}
+	close(srv.shutdownComplete)
+}
+
+// writeText writes a 200 response with the plain text body, the Content-Type
+// is set explicitly so that clients don't have to sniff it.
+func writeText(w http.ResponseWriter, r *http.Request, body string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(httpOK)
+	writeString(w, r, body)
+}
+
+// writeString writes s to the response, a failed write is logged.
+func writeString(w http.ResponseWriter, r *http.Request, s string) {
+	_, err := io.WriteString(w, s)
+	logWriteError(r, err)
+}
+
+// logWriteError logs err if a response couldn't be written, usually because
+// the client went away before it was sent. That is routine, so it is only
+// logged with -log-level=debug.
+func logWriteError(r *http.Request, err error) {
+	if err != nil {
+		slog.Debug("failed to send response", "request_id", requestIDFromContext(r.Context()), "err", err)
+	}
+}
+
+// errWriter keeps the first error of the writes to w and skips the writes
+// after it, so that a response written piece by piece is checked once.
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (ew *errWriter) Write(p []byte) (int, error) {
+	if ew.err != nil {
+		return 0, ew.err
+	}
+	n, err := ew.w.Write(p)
+	ew.err = err
+	return n, err
+}
+
+// writeJSONError writes an error response with the
+// {"error":"<message>","status":<status>} body.
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(struct {
+		Error  string `json:"error"`
+		Status int    `json:"status"`
+	}{message, status})
+	if err != nil {
+		slog.Debug("failed to send response", "err", err)
+	}
+}
+
+// notFound answers requests for unknown routes with a JSON error.
+func notFound(w http.ResponseWriter, r *http.Request) {
+	// r.URL.Path has the /v1 prefix stripped, report the path as requested.
+	path, _, _ := strings.Cut(r.RequestURI, "?")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpNotFound)
+	err := json.NewEncoder(w).Encode(struct {
+		Error  string `json:"error"`
+		Status int    `json:"status"`
+		Path   string `json:"path"`
+	}{"not found", httpNotFound, path})
+	logWriteError(r, err)
+}
+
+// healthz is the liveness probe. It fails once the server starts shutting down.
+func (srv *hashServer) healthz(w http.ResponseWriter, r *http.Request) {
+	if srv.shutdownInProgress.Load() {
+		writeJSONError(w, httpServiceUnavailable, "Shutting down.")
+		return
 	}
-	close(serverShutdownComplete)
+	writeText(w, r, "ok")
 }
 
-func shutdown(w http.ResponseWriter, r *http.Request) {
-	close(gracefulShutdownRequestChan)
+// readyz is the readiness probe. It succeeds only after the server is fully
+// initialized and until it starts shutting down.
+func (srv *hashServer) readyz(w http.ResponseWriter, r *http.Request) {
+	if !srv.ready.Load() {
+		writeJSONError(w, httpServiceUnavailable, "Not ready.")
+		return
+	}
+	if srv.draining.Load() {
+		writeJSONError(w, httpServiceUnavailable, "Draining.")
+		return
+	}
+	writeText(w, r, "ok")
+}
+
+// requestGracefulShutdown starts the graceful shutdown. It is safe to call more than once.
+func (srv *hashServer) requestGracefulShutdown() {
+	srv.shutdownRequestOnce.Do(func() {
+		close(srv.shutdownRequest)
+	})
+}
+
+// shutdownOnSignal starts the graceful shutdown when SIGINT or SIGTERM is received.
+func (srv *hashServer) shutdownOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		srv.logger.Println("Received signal:", sig)
+		srv.requestGracefulShutdown()
+	}()
+}
+
+func (srv *hashServer) shutdown(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpAccepted)
+	writeString(w, r, `{"status":"shutting down"}`+"\n")
+	// Make sure the client gets the acknowledgment before the server stops.
+	if err := http.NewResponseController(w).Flush(); err != nil {
+		log.Printf("request %s: unable to flush shutdown response: %v", requestIDFromContext(r.Context()), err)
+	}
+
+	srv.requestGracefulShutdown()
+}
+
+// loopbackOnly rejects requests that don't originate from a loopback address
+// or the unix socket.
+func loopbackOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Unix socket clients are always local.
+		if _, ok := r.Context().Value(http.LocalAddrContextKey).(*net.UnixAddr); ok {
+			next(w, r)
+			return
+		}
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			writeJSONError(w, httpForbidden, "Forbidden.")
+			return
+		}
+		ip := net.ParseIP(host)
+		if ip == nil || !ip.IsLoopback() {
+			writeJSONError(w, httpForbidden, "Forbidden.")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// requireToken rejects requests that don't present the token either as an
+// "Authorization: Bearer <token>" header or a "token" query parameter.
+func requireToken(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		presented, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			presented = r.URL.Query().Get("token")
+		}
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSONError(w, httpUnauthorized, "Unauthorized.")
+			return
+		}
+		next(w, r)
+	}
 }
@@ -0,0 +1,585 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestServer serves the handlers of a server with no hash delay, configured
+// by the command line args, on an httptest server.
+func newTestServer(t *testing.T, args ...string) *httptest.Server {
+	t.Helper()
+	config, err := loadConfig(append([]string{"-hash-delay", "0"}, args...))
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	storage, err := openStorage(config.DataFile, config.DBPath, config.RedisAddr, config.MaxHashes, config.HashShards)
+	if err != nil {
+		t.Fatalf("openStorage: %v", err)
+	}
+	store := newHashStore(config, storage, nil, nil)
+	var limiter *rateLimiter
+	if config.RateLimit > 0 {
+		limiter = newRateLimiter(config.RateLimit, config.RateBurst)
+	}
+	srv := initHashServer(log.New(io.Discard, "", 0), store, config, []string{"127.0.0.1:0"}, limiter)
+
+	ts := httptest.NewServer(srv.servers[0].Handler)
+	t.Cleanup(func() {
+		ts.Close()
+		store.cancelHashes()
+		storage.Close()
+	})
+	return ts
+}
+
+// request sends the request and returns the status and body of the response.
+func request(t *testing.T, method, url, contentType, body string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("%s %s: reading the body: %v", method, url, err)
+	}
+	return resp.StatusCode, string(content)
+}
+
+func postPassword(t *testing.T, ts *httptest.Server, password string) idAndHash {
+	t.Helper()
+	status, body := request(t, http.MethodPost, ts.URL+"/hash", "application/x-www-form-urlencoded", url.Values{"password": {password}}.Encode())
+	if status != httpOK {
+		t.Fatalf("POST /hash: got status %d, body %q", status, body)
+	}
+	var created idAndHash
+	if err := json.Unmarshal([]byte(body), &created); err != nil {
+		t.Fatalf("POST /hash: decoding %q: %v", body, err)
+	}
+	return created
+}
+
+func TestCreateAndGetHash(t *testing.T) {
+	ts := newTestServer(t)
+	const password = "angryMonkey"
+
+	created := postPassword(t, ts, password)
+	if created.ID != float64(1) {
+		t.Fatalf("POST /hash: got id %v, want 1", created.ID)
+	}
+
+	status, hash := request(t, http.MethodGet, ts.URL+"/hash/1", "", "")
+	if status != httpOK {
+		t.Fatalf("GET /hash/1: got status %d, body %q", status, hash)
+	}
+	if hash != created.Hash {
+		t.Errorf("GET /hash/1: got %q, the POST returned %q", hash, created.Hash)
+	}
+
+	encodedSalt, encodedHash, ok := strings.Cut(hash, ":")
+	if !ok {
+		t.Fatalf("GET /hash/1: %q is not <salt>:<hash>", hash)
+	}
+	salt, err := base64.StdEncoding.DecodeString(encodedSalt)
+	if err != nil {
+		t.Fatalf("GET /hash/1: decoding the salt %q: %v", encodedSalt, err)
+	}
+	sum := sha256.Sum256(append(salt, password...))
+	if want := base64.StdEncoding.EncodeToString(sum[:]); encodedHash != want {
+		t.Errorf("GET /hash/1: got hash %q, want the salted SHA-256 %q", encodedHash, want)
+	}
+}
+
+func TestStatsTotal(t *testing.T) {
+	ts := newTestServer(t)
+	postPassword(t, ts, "angryMonkey")
+	postPassword(t, ts, "happyMonkey")
+
+	status, body := request(t, http.MethodGet, ts.URL+"/stats", "", "")
+	if status != httpOK {
+		t.Fatalf("GET /stats: got status %d, body %q", status, body)
+	}
+	var stats struct {
+		Total int64 `json:"total"`
+	}
+	if err := json.Unmarshal([]byte(body), &stats); err != nil {
+		t.Fatalf("GET /stats: decoding %q: %v", body, err)
+	}
+	if stats.Total != 2 {
+		t.Errorf("GET /stats: got a total of %d, want 2", stats.Total)
+	}
+}
+
+func TestErrorResponses(t *testing.T) {
+	ts := newTestServer(t)
+	postPassword(t, ts, "angryMonkey")
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		contentType string
+		body        string
+		want        int
+	}{
+		{"unknown hash id", http.MethodGet, "/hash/2", "", "", httpNotFound},
+		{"malformed hash id", http.MethodGet, "/hash/abc", "", "", httpBadRequest},
+		{"unknown route", http.MethodGet, "/nope", "", "", httpNotFound},
+		{"missing password", http.MethodPost, "/hash", "application/x-www-form-urlencoded", "", httpBadRequest},
+		{"malformed form body", http.MethodPost, "/hash", "application/x-www-form-urlencoded", "password=%zz", httpBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status, body := request(t, test.method, ts.URL+test.path, test.contentType, test.body)
+			if status != test.want {
+				t.Errorf("%s %s: got status %d, want %d, body %q", test.method, test.path, status, test.want, body)
+			}
+		})
+	}
+}
+
+func TestDedupForgetsDeletedHashes(t *testing.T) {
+	ts := newTestServer(t, "-dedup")
+
+	first := postPassword(t, ts, "angryMonkey")
+	if again := postPassword(t, ts, "angryMonkey"); again.ID != first.ID {
+		t.Fatalf("POST /hash: got id %v for the same password, want %v", again.ID, first.ID)
+	}
+
+	if status, body := request(t, http.MethodDelete, ts.URL+"/hash/1", "", ""); status != httpNoContent {
+		t.Fatalf("DELETE /hash/1: got status %d, body %q", status, body)
+	}
+	if again := postPassword(t, ts, "angryMonkey"); again.ID != float64(2) {
+		t.Errorf("POST /hash: got id %v after deleting the hash, want a new id 2", again.ID)
+	}
+}
+
+func TestIdempotencyKeyIsBoundToTheRequest(t *testing.T) {
+	ts := newTestServer(t)
+	post := func(password string) (int, string) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/hash", strings.NewReader(url.Values{"password": {password}}.Encode()))
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set(idempotencyKeyHeader, "3f1c2a")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST /hash: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	status, first := post("angryMonkey")
+	if status != httpOK {
+		t.Fatalf("POST /hash: got status %d, body %q", status, first)
+	}
+	if status, retry := post("angryMonkey"); status != httpOK || retry != first {
+		t.Errorf("retried POST /hash: got status %d, body %q, want %q", status, retry, first)
+	}
+	if status, body := post("happyMonkey"); status != httpUnprocessableEntity {
+		t.Errorf("POST /hash with the key of another request: got status %d, body %q, want %d", status, body, httpUnprocessableEntity)
+	}
+}
+
+func TestUUIDIDs(t *testing.T) {
+	ts := newTestServer(t, "-id-format", "uuid", "-shutdown-token", "s3cret")
+
+	created := postPassword(t, ts, "angryMonkey")
+	uuid, ok := created.ID.(string)
+	if !ok || !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(uuid) {
+		t.Fatalf("POST /hash: got id %v, want a version 4 UUID", created.ID)
+	}
+	if status, hash := request(t, http.MethodGet, ts.URL+"/hash/"+uuid, "", ""); status != httpOK || hash != created.Hash {
+		t.Errorf("GET /hash/%s: got status %d, body %q, want %q", uuid, status, hash, created.Hash)
+	}
+	if status, body := request(t, http.MethodGet, ts.URL+"/hash/2636a7f3-dfc3-4503-9e0e-8789a300c8c7", "", ""); status != httpNotFound {
+		t.Errorf("GET /hash/<another UUID>: got status %d, body %q, want %d", status, body, httpNotFound)
+	}
+
+	if status, body := request(t, http.MethodGet, ts.URL+"/count", "", ""); status != httpUnauthorized {
+		t.Errorf("GET /count: got status %d, body %q, want %d", status, body, httpUnauthorized)
+	}
+	if status, body := request(t, http.MethodGet, ts.URL+"/count?token=s3cret", "", ""); status != httpOK {
+		t.Errorf("GET /count with the token: got status %d, body %q", status, body)
+	}
+}
+
+func TestUUIDKeyIsPersistent(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	first, again := newUUIDCodec(key), newUUIDCodec(key)
+	for _, id := range []int{1, 2, 1 << 40, math.MaxInt} {
+		uuid := first.format(id)
+		if got, err := again.parse(uuid); err != nil || got != id {
+			t.Errorf("parse(%q) with the same key: got %d, %v, want %d", uuid, got, err, id)
+		}
+	}
+	if got, err := newUUIDCodec(nil).parse(first.format(1)); err != nil || got == 1 {
+		t.Errorf("parse with another key: got %d, %v, want an id other than 1", got, err)
+	}
+}
+
+func TestHashScheduledAfterCancelIsAbandoned(t *testing.T) {
+	config, err := loadConfig([]string{"-hash-delay", "1h"})
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	hs := newHashStore(config, newMemoryStore(0), nil, nil)
+	hs.cancelHashes()
+
+	id, err := hs.reserveHash()
+	if err != nil {
+		t.Fatalf("reserveHash: %v", err)
+	}
+	hs.scheduleReservedHash(context.Background(), id, func() (hashedEntry, error) {
+		t.Error("the hash was computed, want it abandoned")
+		return hashedEntry{}, nil
+	})
+
+	abandoned := make(chan struct{})
+	go func() {
+		hs.pendingHashesWaitGroup.Wait()
+		close(abandoned)
+	}()
+	select {
+	case <-abandoned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the hash is still pending after the hash context was cancelled")
+	}
+}
+
+func TestReadyAtIsWhenTheHashWasScheduled(t *testing.T) {
+	ts := newTestServer(t, "-hash-delay", "1h", "-response-style", "json")
+	post := func() pendingID {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/hash", strings.NewReader("password=angryMonkey"))
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set(idempotencyKeyHeader, "3f1c2a")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST /hash: %v", err)
+		}
+		defer resp.Body.Close()
+		var created pendingID
+		if err := json.NewDecoder(resp.Body).Decode(&created); err != nil || created.ReadyAt == nil {
+			t.Fatalf("POST /hash: got %+v, %v, want a pending id with ready_at", created, err)
+		}
+		return created
+	}
+
+	first := post()
+	time.Sleep(10 * time.Millisecond)
+	if retry := post(); !retry.ReadyAt.Equal(*first.ReadyAt) {
+		t.Errorf("retried POST /hash: got ready_at %v, want %v from the first request", retry.ReadyAt, first.ReadyAt)
+	}
+}
+
+func TestStreamRetryGetsNoEarlyHint(t *testing.T) {
+	ts := newTestServer(t, "-hash-delay", "1h")
+	post := func() (string, []string) {
+		t.Helper()
+		var hinted []string
+		trace := &httptrace.ClientTrace{
+			Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+				if code == httpEarlyHints {
+					hinted = append(hinted, header.Get(hashIDHeader))
+				}
+				return nil
+			},
+		}
+		req, err := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), http.MethodPost, ts.URL+"/hash", strings.NewReader("angryMonkey"))
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set(idempotencyKeyHeader, "3f1c2a")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST /hash: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != httpOK {
+			t.Fatalf("POST /hash: got status %d, body %q", resp.StatusCode, body)
+		}
+		return string(body), hinted
+	}
+
+	id, hinted := post()
+	if len(hinted) != 1 || hinted[0] != id {
+		t.Fatalf("POST /hash: got early hints %q, want one with the id %q", hinted, id)
+	}
+	if retry, hinted := post(); retry != id || len(hinted) != 0 {
+		t.Errorf("retried POST /hash: got id %q and early hints %q, want %q and no early hint", retry, hinted, id)
+	}
+}
+
+func TestStatsPrometheusTypes(t *testing.T) {
+	histogram := newStatsHistogram(statsHistogramBounds)
+	histogram.observe(100)
+	histogram.observe(200)
+	stats := map[string]interface{}{
+		"total":     int64(2),
+		"average":   int64(150),
+		"histogram": histogram,
+	}
+	var out strings.Builder
+	writeStatsPrometheus(&out, stats)
+
+	for _, want := range []string{
+		"# TYPE hash_stats_total counter\nhash_stats_total 2\n",
+		"# TYPE hash_stats_average gauge\n",
+		"hash_stats_histogram_sum 300\nhash_stats_histogram_count 2\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("writeStatsPrometheus: %q is missing from\n%s", want, out.String())
+		}
+	}
+}
+
+func TestStalledUploadTimesOut(t *testing.T) {
+	ts := newTestServer(t, "-read-timeout", "200ms", "-hash-delay", "1h")
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	// Only part of the body is sent, then the client stalls.
+	io.WriteString(conn, "POST /hash HTTP/1.1\r\nHost: localhost\r\nContent-Type: application/octet-stream\r\nContent-Length: 100\r\n\r\nangry")
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	response, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("reading the response: %v", err)
+	}
+	if !strings.Contains(string(response), "400 Bad Request") {
+		t.Errorf("got %q, want a 400 once the read deadline passed", response)
+	}
+}
+
+func TestBatchOverTheQueueSizeSchedulesNothing(t *testing.T) {
+	ts := newTestServer(t, "-hash-delay", "1h", "-hash-workers", "1", "-hash-queue-size", "2")
+	post := func(passwords ...string) (int, string) {
+		t.Helper()
+		return request(t, http.MethodPost, ts.URL+"/hash", "application/x-www-form-urlencoded", url.Values{"password": passwords}.Encode())
+	}
+
+	if status, body := post("angryMonkey", "happyMonkey", "sadMonkey"); status != httpServiceUnavailable {
+		t.Fatalf("POST /hash with 3 passwords: got status %d, body %q, want %d", status, body, httpServiceUnavailable)
+	}
+	// The ids reserved for the first passwords were given up along with the
+	// queue slots.
+	if status, body := post("angryMonkey", "happyMonkey"); status != httpOK {
+		t.Errorf("POST /hash with 2 passwords: got status %d, body %q, want the queue to have room", status, body)
+	}
+}
+
+func TestStatsKeepABoundedSample(t *testing.T) {
+	config, err := loadConfig(nil)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	hs := newHashStore(config, newMemoryStore(0), nil, nil)
+	for range statsSampleSize + 500 {
+		hs.storeHashRequestProcessingDuration(time.Now(), 1, defaultHashAlgorithm)
+	}
+
+	if got := len(hs.hashRequestProcessingDurations); got != statsSampleSize {
+		t.Errorf("got %d recorded durations, want the last %d", got, statsSampleSize)
+	}
+	stats := hs.collectStats()
+	var counted int
+	for _, count := range stats["histogram"].(statsHistogram).Counts {
+		counted += count
+	}
+	if counted != statsSampleSize+500 || stats["total"] != int64(statsSampleSize+500) {
+		t.Errorf("got a total of %v and %d durations in the histogram, want %d", stats["total"], counted, statsSampleSize+500)
+	}
+}
+
+func TestEmptyShardedStoreListsNoIDs(t *testing.T) {
+	ts := newTestServer(t, "-hash-shards", "4")
+	for path, want := range map[string]string{
+		"/hashes":         "[]\n",
+		"/hashes?limit=1": `{"ids":[],"next":null}` + "\n",
+	} {
+		if status, body := request(t, http.MethodGet, ts.URL+path, "", ""); status != httpOK || body != want {
+			t.Errorf("GET %s: got status %d, body %q, want %q", path, status, body, want)
+		}
+	}
+}
+
+func TestVerifyIsRateLimited(t *testing.T) {
+	ts := newTestServer(t, "-rate-limit", "0.001", "-rate-burst", "1")
+	verify := func() int {
+		t.Helper()
+		status, _ := request(t, http.MethodPost, ts.URL+"/v1/verify/1", "application/x-www-form-urlencoded", "password=angryMonkey")
+		return status
+	}
+
+	verify()
+	if status := verify(); status != httpTooManyRequests {
+		t.Errorf("POST /v1/verify/1 over the rate limit: got status %d, want %d", status, httpTooManyRequests)
+	}
+}
+
+func TestUploadOverMaxUploadBytes(t *testing.T) {
+	t.Setenv("MAX_UPLOAD_BYTES", "8")
+	ts := newTestServer(t)
+
+	tests := []struct {
+		body string
+		want int
+	}{
+		{"angryMon", httpOK},
+		{"angryMonkey", httpBadRequest},
+	}
+	for _, test := range tests {
+		if status, body := request(t, http.MethodPost, ts.URL+"/hash", "application/octet-stream", test.body); status != test.want {
+			t.Errorf("POST /hash with a %d byte body: got status %d, body %q, want %d", len(test.body), status, body, test.want)
+		}
+	}
+}
+
+func TestOpenAPIDescribesTheRoutes(t *testing.T) {
+	ts := newTestServer(t)
+	status, body := request(t, http.MethodGet, ts.URL+"/openapi.json", "", "")
+	if status != httpOK {
+		t.Fatalf("GET /openapi.json: got status %d", status)
+	}
+	var spec struct {
+		Paths map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal([]byte(body), &spec); err != nil {
+		t.Fatalf("GET /openapi.json: decoding: %v", err)
+	}
+	for _, path := range []string{"/hash", "/hash/{id}", "/verify/{id}", "/digest", "/hashes", "/count", "/stats", "/stats/reset", "/metrics", "/version", "/openapi.json", "/debug/memstats", "/healthz", "/readyz", "/shutdown", "/drain"} {
+		if _, ok := spec.Paths[path]; !ok {
+			t.Errorf("GET /openapi.json: %s is not described", path)
+		}
+	}
+}
+
+func TestUnknownRouteBody(t *testing.T) {
+	ts := newTestServer(t)
+	status, body := request(t, http.MethodGet, ts.URL+"/v1/nope?x=1", "", "")
+	if want := `{"error":"not found","status":404,"path":"/v1/nope"}` + "\n"; status != httpNotFound || body != want {
+		t.Errorf("GET /v1/nope: got status %d, body %q, want %q", status, body, want)
+	}
+}
+
+func TestHashesPagination(t *testing.T) {
+	empty := newTestServer(t)
+	ts := newTestServer(t)
+	for _, password := range []string{"angryMonkey", "happyMonkey", "sadMonkey"} {
+		postPassword(t, ts, password)
+	}
+
+	tests := []struct {
+		name       string
+		ts         *httptest.Server
+		query      string
+		wantStatus int
+		wantBody   string
+	}{
+		{"empty store", empty, "limit=2", httpOK, `{"ids":[],"next":null}`},
+		{"first page", ts, "limit=2", httpOK, `{"ids":[1,2],"next":2}`},
+		{"last page", ts, "limit=2&after=2", httpOK, `{"ids":[3],"next":null}`},
+		{"cursor past the end", ts, "after=3", httpOK, `{"ids":[],"next":null}`},
+		{"cursor of a missing id", ts, "limit=1&after=0", httpOK, `{"ids":[1],"next":1}`},
+		{"bad cursor", ts, "after=abc", httpBadRequest, ""},
+		{"negative cursor", ts, "after=-1", httpBadRequest, ""},
+		{"zero limit", ts, "limit=0", httpBadRequest, ""},
+		{"bad limit", ts, "limit=abc", httpBadRequest, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status, body := request(t, http.MethodGet, test.ts.URL+"/hashes?"+test.query, "", "")
+			if status != test.wantStatus {
+				t.Fatalf("GET /hashes?%s: got status %d, body %q, want %d", test.query, status, body, test.wantStatus)
+			}
+			if test.wantBody != "" && body != test.wantBody+"\n" {
+				t.Errorf("GET /hashes?%s: got %q, want %q", test.query, body, test.wantBody)
+			}
+		})
+	}
+}
+
+func TestDrainRefusesNewHashes(t *testing.T) {
+	ts := newTestServer(t)
+	postPassword(t, ts, "angryMonkey")
+
+	if status, body := request(t, http.MethodPost, ts.URL+"/drain", "", ""); status != httpAccepted {
+		t.Fatalf("POST /drain: got status %d, body %q", status, body)
+	}
+	tests := []struct {
+		method      string
+		path        string
+		contentType string
+		body        string
+		want        int
+	}{
+		{http.MethodPost, "/hash", "application/x-www-form-urlencoded", "password=happyMonkey", httpServiceUnavailable},
+		{http.MethodGet, "/hash/1", "", "", httpOK},
+		{http.MethodGet, "/stats", "", "", httpOK},
+	}
+	for _, test := range tests {
+		if status, body := request(t, test.method, ts.URL+test.path, test.contentType, test.body); status != test.want {
+			t.Errorf("%s %s while draining: got status %d, body %q, want %d", test.method, test.path, status, body, test.want)
+		}
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	ts := newTestServer(t, "-base-path", "/hashsvc")
+	status, body := request(t, http.MethodPost, ts.URL+"/hashsvc/hash", "application/x-www-form-urlencoded", "password=angryMonkey")
+	if status != httpOK {
+		t.Fatalf("POST /hashsvc/hash: got status %d, body %q", status, body)
+	}
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/hashsvc/hash/1", httpOK},
+		{"/hashsvc/v1/hash/1", httpOK},
+		{"/hashsvc/stats", httpOK},
+		{"/hash/1", httpNotFound},
+		{"/v1/hash/1", httpNotFound},
+	}
+	for _, test := range tests {
+		if status, body := request(t, http.MethodGet, ts.URL+test.path, "", ""); status != test.want {
+			t.Errorf("GET %s: got status %d, body %q, want %d", test.path, status, body, test.want)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const idempotencyKeyHeader = "Idempotency-Key"
+
+var errIdempotencyKeyReused = errors.New("idempotency key reused for a different request")
+
+// idempotencyCache remembers the ids assigned to the requests that carried an
+// Idempotency-Key, so that a retried request gets the same ids. Every key is
+// bound to a digest of its request, the key of one request can't be used to
+// get the ids of another. Keys are forgotten after ttl.
+type idempotencyCache struct {
+	mutex     sync.Mutex
+	ttl       time.Duration
+	results   map[string]*idempotentResult
+	lastSweep time.Time
+}
+
+// idempotentResult holds the ids of a key, once done is closed.
+type idempotentResult struct {
+	digest    string
+	done      chan struct{}
+	hashIds   []int
+	err       error
+	expiresAt time.Time
+}
+
+func newIdempotencyCache(ttl time.Duration) *idempotencyCache {
+	return &idempotencyCache{
+		ttl:       ttl,
+		results:   make(map[string]*idempotentResult),
+		lastSweep: time.Now(),
+	}
+}
+
+// do returns the ids assigned to an earlier request with the key, or calls
+// schedule and remembers its ids. A request with the same key as one that is
+// still being scheduled waits for its ids, requests with other keys are not
+// held up. errIdempotencyKeyReused is returned if the key was used for a
+// request with another digest.
+func (ic *idempotencyCache) do(key, digest string, schedule func() ([]int, error)) ([]int, error) {
+	ic.mutex.Lock()
+	now := time.Now()
+	if now.Sub(ic.lastSweep) > ic.ttl {
+		ic.removeExpired(now)
+	}
+	if result, ok := ic.results[key]; ok && !result.expired(now) {
+		ic.mutex.Unlock()
+		if result.digest != digest {
+			return nil, errIdempotencyKeyReused
+		}
+		<-result.done
+		return result.hashIds, result.err
+	}
+	result := &idempotentResult{digest: digest, done: make(chan struct{})}
+	ic.results[key] = result
+	ic.mutex.Unlock()
+
+	result.hashIds, result.err = schedule()
+
+	ic.mutex.Lock()
+	// A failed request is not remembered, so that it can be retried.
+	if result.err != nil {
+		delete(ic.results, key)
+	}
+	result.expiresAt = time.Now().Add(ic.ttl)
+	ic.mutex.Unlock()
+	close(result.done)
+	return result.hashIds, result.err
+}
+
+// has reports whether the ids of an earlier request with the key are
+// remembered, or still being scheduled.
+func (ic *idempotencyCache) has(key string) bool {
+	ic.mutex.Lock()
+	defer ic.mutex.Unlock()
+	result, ok := ic.results[key]
+	return ok && !result.expired(time.Now())
+}
+
+// removeExpired drops the expired keys so the map doesn't grow without bound.
+// Must be called with the mutex held.
+func (ic *idempotencyCache) removeExpired(now time.Time) {
+	for key, result := range ic.results {
+		if result.expired(now) {
+			delete(ic.results, key)
+		}
+	}
+	ic.lastSweep = now
+}
+
+// expired reports whether the ids of the result are no longer returned. A
+// result that is still being scheduled doesn't expire. Must be called with
+// the mutex held.
+func (result *idempotentResult) expired(now time.Time) bool {
+	select {
+	case <-result.done:
+		return !now.Before(result.expiresAt)
+	default:
+		return false
+	}
+}
+
+// requestDigest returns the digest an Idempotency-Key is bound to, of the
+// query and the passwords or streamed body of the request.
+func requestDigest(r *http.Request, parts ...[]byte) string {
+	digest := sha256.New()
+	io.WriteString(digest, r.URL.Query().Encode())
+	for _, part := range parts {
+		binary.Write(digest, binary.BigEndian, uint64(len(part)))
+		digest.Write(part)
+	}
+	return hex.EncodeToString(digest.Sum(nil))
+}
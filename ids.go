@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+const (
+	integerIDFormat = "integer"
+	uuidIDFormat    = "uuid"
+)
+
+// minIDKeyBytes is the shortest key accepted in -id-key-file.
+const minIDKeyBytes = 16
+
+// A UUID carries 122 random bits besides its version and variant, the
+// Feistel network encrypts them as two 61 bit halves.
+const (
+	uuidHalfBits = 61
+	uuidHalfMask = 1<<uuidHalfBits - 1
+	uuidRounds   = 8
+)
+
+var errInvalidHashID = errors.New("invalid hash id")
+
+// uuidCodec presents the sequential hash ids as opaque version 4 UUIDs. An id
+// is encrypted with a keyed Feistel network over the random bits of the UUID,
+// so the UUIDs can't be enumerated or counted and no id to UUID mapping has
+// to be stored. The same key gives the same UUIDs across restarts.
+type uuidCodec struct {
+	key []byte
+}
+
+// newUUIDCodec returns a codec for the key, or for a random key if it is nil.
+func newUUIDCodec(key []byte) *uuidCodec {
+	if key == nil {
+		key = make([]byte, 32)
+		rand.Read(key)
+	}
+	return &uuidCodec{key: key}
+}
+
+// round is the Feistel function of round i.
+func (u *uuidCodec) round(i int, half uint64) uint64 {
+	var input [9]byte
+	input[0] = byte(i)
+	binary.BigEndian.PutUint64(input[1:], half)
+	mac := hmac.New(sha256.New, u.key)
+	mac.Write(input[:])
+	return binary.BigEndian.Uint64(mac.Sum(nil)) & uuidHalfMask
+}
+
+func (u *uuidCodec) format(id int) string {
+	left, right := uint64(id)>>uuidHalfBits, uint64(id)&uuidHalfMask
+	for i := range uuidRounds {
+		left, right = right, left^u.round(i, right)
+	}
+
+	// The top 60 bits go around the version nibble, the last 62 after the
+	// variant bits.
+	top := left >> 1
+	var uuid [16]byte
+	binary.BigEndian.PutUint64(uuid[:8], top>>12<<16|0x4<<12|top&0xfff)
+	binary.BigEndian.PutUint64(uuid[8:], 0b10<<62|(left&1)<<uuidHalfBits|right)
+	encoded := hex.EncodeToString(uuid[:])
+	return encoded[:8] + "-" + encoded[8:12] + "-" + encoded[12:16] + "-" + encoded[16:20] + "-" + encoded[20:]
+}
+
+// parse returns the id of a UUID. A well-formed version 4 UUID that wasn't
+// issued with this key returns 0, which is never assigned.
+func (u *uuidCodec) parse(s string) (int, error) {
+	if len(s) != 36 || s[8] != '-' || s[13] != '-' || s[18] != '-' || s[23] != '-' {
+		return 0, errInvalidHashID
+	}
+	uuid, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil {
+		return 0, errInvalidHashID
+	}
+	high, low := binary.BigEndian.Uint64(uuid[:8]), binary.BigEndian.Uint64(uuid[8:])
+	if high>>12&0xf != 0x4 || low>>62 != 0b10 {
+		return 0, errInvalidHashID
+	}
+
+	top := high>>16<<12 | high&0xfff
+	left, right := top<<1|low>>uuidHalfBits&1, low&uuidHalfMask
+	for i := uuidRounds - 1; i >= 0; i-- {
+		left, right = right^u.round(i, left), left
+	}
+	// An id has 63 bits, the left half of one holds at most 2.
+	if left > 0b11 {
+		return 0, nil
+	}
+	return int(left<<uuidHalfBits | right), nil
+}
+
+// formatID returns id as it is shown to clients: the integer itself or, with
+// -id-format=uuid, its UUID.
+func (hs *hashStore) formatID(id int) string {
+	if hs.uuids != nil {
+		return hs.uuids.format(id)
+	}
+	return strconv.Itoa(id)
+}
+
+// jsonID returns id as it is encoded in JSON responses, a number or a UUID
+// string.
+func (hs *hashStore) jsonID(id int) interface{} {
+	if hs.uuids != nil {
+		return hs.uuids.format(id)
+	}
+	return id
+}
+
+// jsonIDs returns the ids as they are encoded in JSON responses.
+func (hs *hashStore) jsonIDs(ids []int) interface{} {
+	if hs.uuids == nil {
+		return ids
+	}
+	formatted := make([]string, len(ids))
+	for i, id := range ids {
+		formatted[i] = hs.uuids.format(id)
+	}
+	return formatted
+}
+
+// parseID returns the id of a hash as sent by a client.
+func (hs *hashStore) parseID(s string) (int, error) {
+	if hs.uuids != nil {
+		return hs.uuids.parse(s)
+	}
+	return strconv.Atoi(s)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"time"
+)
+
+const (
+	textLogFormat = "text"
+	jsonLogFormat = "json"
+)
+
+// newLogger returns the server logger for the given format. With the JSON
+// format the standard log package and slog are redirected to the same
+// handler, so every log line is a JSON object. The slog messages below level,
+// debug, info, warn or error, are dropped.
+func newLogger(format, level string) (*log.Logger, error) {
+	var minLevel slog.Level
+	if err := minLevel.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("unsupported log level: %s", level)
+	}
+	switch format {
+	case textLogFormat:
+		slog.SetLogLoggerLevel(minLevel)
+		return log.New(os.Stdout, "http: ", log.LstdFlags), nil
+	case jsonLogFormat:
+		handler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: minLevel})
+		slog.SetDefault(slog.New(handler))
+		return slog.NewLogLogger(handler, slog.LevelInfo), nil
+	default:
+		return nil, fmt.Errorf("unsupported log format: %s", format)
+	}
+}
+
+// statusRecorder captures the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	// An informational response is followed by the actual one.
+	if status >= 200 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, e.g. to
+// flush it.
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// accessLog logs the method, path, client IP, status and duration of every
+// request.
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: httpOK}
+		next.ServeHTTP(recorder, r)
+
+		clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			clientIP = r.RemoteAddr
+		}
+		slog.Info("request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"request_id", requestIDFromContext(r.Context()),
+			"client_ip", clientIP,
+			"status", recorder.status,
+			"duration", time.Since(start),
+		)
+	})
+}
+
+// recoverPanics turns a panicking handler into a 500 response instead of
+// crashing the server.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+			log.Printf("request %s: panic serving %s: %v\n%s", requestIDFromContext(r.Context()), r.URL.Path, err, debug.Stack())
+			writeJSONError(w, httpInternalServerError, "Internal server error.")
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+const requestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// withRequestID tags every request with the incoming X-Request-ID header, or
+// a newly generated UUID, and echoes it back in the response.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if id == "" {
+			id = newUUID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// requestIDFromContext returns the id of the request the context belongs to.
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// newUUID returns a random version 4 UUID.
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
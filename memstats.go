@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+)
+
+// memStats are the Go runtime memory stats reported by /debug/memstats.
+type memStats struct {
+	AllocBytes      uint64 `json:"alloc_bytes"`
+	TotalAllocBytes uint64 `json:"total_alloc_bytes"`
+	SysBytes        uint64 `json:"sys_bytes"`
+	HeapInuseBytes  uint64 `json:"heap_inuse_bytes"`
+	HeapObjects     uint64 `json:"heap_objects"`
+	NumGC           uint32 `json:"num_gc"`
+	Goroutines      int    `json:"goroutines"`
+}
+
+// debugMemStats reports the Go runtime memory stats and the number of
+// goroutines, e.g. to spot a growing hash store or leaked timers. Reading the
+// stats stops the world briefly, which is why they are not part of /stats.
+func debugMemStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeJSONError(w, httpMethodNotAllowed, "Method not allowed.")
+		return
+	}
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(memStats{
+		AllocBytes:      ms.Alloc,
+		TotalAllocBytes: ms.TotalAlloc,
+		SysBytes:        ms.Sys,
+		HeapInuseBytes:  ms.HeapInuse,
+		HeapObjects:     ms.HeapObjects,
+		NumGC:           ms.NumGC,
+		Goroutines:      runtime.NumGoroutine(),
+	})
+	logWriteError(r, err)
+}
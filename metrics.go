@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// processingDurationBuckets are the upper bounds, in seconds, of the hash
+// request processing duration histogram buckets.
+var processingDurationBuckets = []float64{0.00001, 0.000025, 0.00005, 0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01}
+
+// histogram accumulates observations into Prometheus style buckets.
+type histogram struct {
+	mutex   sync.Mutex
+	buckets []float64
+	// counts holds the number of observations per bucket(not cumulative).
+	// The last element counts the observations above the highest bucket.
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)+1),
+	}
+}
+
+func (h *histogram) observe(value float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	i := 0
+	for i < len(h.buckets) && value > h.buckets[i] {
+		i++
+	}
+	h.counts[i]++
+	h.sum += value
+	h.count++
+}
+
+// write writes the histogram in the Prometheus text exposition format.
+func (h *histogram) write(w io.Writer, name, help string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	var cumulative uint64
+	for i, bound := range h.buckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+	}
+	cumulative += h.counts[len(h.buckets)]
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, cumulative)
+	fmt.Fprintf(w, "%s_sum %s\n", name, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+// acceptsPrometheus reports whether the Accept header prefers text/plain, i.e.
+// the Prometheus text exposition format, over application/json. The first of the
+// two media types listed wins, JSON is the default.
+func acceptsPrometheus(accept string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case "text/plain":
+			return true
+		case "application/json":
+			return false
+		}
+	}
+	return false
+}
+
+// writeStatsPrometheus writes the /stats values as hash_stats_<name> gauges, or
+// counters for the _total ones, and the processing duration histogram as
+// hash_stats_histogram and the algorithm stats as hash_stats_algorithms_total
+// and _average, in the Prometheus text exposition format.
+func writeStatsPrometheus(w io.Writer, stats map[string]interface{}) {
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		metric := "hash_stats_" + name
+		switch value := stats[name].(type) {
+		case statsHistogram:
+			fmt.Fprintf(w, "# TYPE %s histogram\n", metric)
+			var cumulative int
+			for i, bound := range value.Bounds {
+				cumulative += value.Counts[i]
+				fmt.Fprintf(w, "%s_bucket{le=\"%d\"} %d\n", metric, bound, cumulative)
+			}
+			cumulative += value.Counts[len(value.Bounds)]
+			fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", metric, cumulative)
+			fmt.Fprintf(w, "%s_sum %d\n", metric, value.Sum)
+			fmt.Fprintf(w, "%s_count %d\n", metric, cumulative)
+		case map[string]algorithmStats:
+			fmt.Fprintf(w, "# TYPE %s_total counter\n", metric)
+			for _, algorithm := range slices.Sorted(maps.Keys(value)) {
+				fmt.Fprintf(w, "%s_total{algorithm=%q} %d\n", metric, algorithm, value[algorithm].Total)
+			}
+			fmt.Fprintf(w, "# TYPE %s_average gauge\n", metric)
+			for _, algorithm := range slices.Sorted(maps.Keys(value)) {
+				fmt.Fprintf(w, "%s_average{algorithm=%q} %d\n", metric, algorithm, value[algorithm].Average)
+			}
+		default:
+			metricType := "gauge"
+			if strings.HasSuffix(metric, "_total") {
+				metricType = "counter"
+			}
+			fmt.Fprintf(w, "# TYPE %s %s\n", metric, metricType)
+			fmt.Fprintf(w, "%s %v\n", metric, value)
+		}
+	}
+}
+
+// metrics exposes the hash server metrics in the Prometheus text exposition format.
+// Unlike /stats these are never reset.
+func (hs *hashStore) metrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeJSONError(w, httpMethodNotAllowed, "Method not allowed.")
+		return
+	}
+
+	pending := hs.pendingCount()
+
+	hs.processingDurationHistogram.mutex.Lock()
+	total := hs.processingDurationHistogram.count
+	hs.processingDurationHistogram.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	ew := &errWriter{w: w}
+	fmt.Fprintln(ew, "# HELP hash_requests_total Total number of hash requests.")
+	fmt.Fprintln(ew, "# TYPE hash_requests_total counter")
+	fmt.Fprintf(ew, "hash_requests_total %d\n", total)
+
+	fmt.Fprintln(ew, "# HELP hash_pending Number of hashes that are not computed yet.")
+	fmt.Fprintln(ew, "# TYPE hash_pending gauge")
+	fmt.Fprintf(ew, "hash_pending %d\n", pending)
+
+	hs.processingDurationHistogram.write(ew, "hash_request_processing_duration_seconds", "Hash request processing duration in seconds.")
+	logWriteError(r, ew.err)
+}
@@ -0,0 +1,12 @@
+//go:build panictest
+
+package main
+
+import "net/http"
+
+// Registers a route that always panics, used by tests/panic_recovery.sh.
+func init() {
+	testRoutes["/panic"] = func(w http.ResponseWriter, r *http.Request) {
+		panic("test panic")
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// saveRetryDelay is how long a failed save of the data file waits before it
+// is retried.
+const saveRetryDelay = time.Second
+
+type persistedEntry struct {
+	Algorithm string    `json:"algorithm"`
+	Encoding  string    `json:"encoding"`
+	Salt      []byte    `json:"salt,omitempty"`
+	Hash      string    `json:"hash"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func newPersistedEntry(entry hashedEntry) persistedEntry {
+	return persistedEntry{
+		Algorithm: entry.algorithm,
+		Encoding:  entry.encoding,
+		Salt:      entry.salt,
+		Hash:      entry.hash,
+		CreatedAt: entry.createdAt,
+	}
+}
+
+func (pe persistedEntry) hashedEntry() hashedEntry {
+	return hashedEntry{
+		algorithm: pe.Algorithm,
+		encoding:  pe.Encoding,
+		salt:      pe.Salt,
+		hash:      pe.Hash,
+		createdAt: pe.CreatedAt,
+	}
+}
+
+// persistedData is the content of the data file.
+type persistedData struct {
+	Counter int                    `json:"counter"`
+	Hashes  map[int]persistedEntry `json:"hashes"`
+}
+
+// fileStore is a memoryStore that persists the hashes and the id counter to
+// a JSON data file so that they survive restarts.
+type fileStore struct {
+	*memoryStore
+
+	path         string
+	saveMutex    sync.Mutex
+	saveRequests chan struct{}
+	stopSaver    chan struct{}
+	saverDone    chan struct{}
+}
+
+// newFileStore restores the hashes from the data file at path.
+// A missing data file is not an error, the store simply starts empty.
+func newFileStore(path string, maxHashes int) (*fileStore, error) {
+	fs := &fileStore{
+		memoryStore:  newMemoryStore(maxHashes),
+		path:         path,
+		saveRequests: make(chan struct{}, 1),
+		stopSaver:    make(chan struct{}),
+		saverDone:    make(chan struct{}),
+	}
+	if err := fs.load(); err != nil {
+		return nil, err
+	}
+	go fs.saveInBackground()
+	return fs, nil
+}
+
+func (fs *fileStore) NextID() (int, error) {
+	id, err := fs.memoryStore.NextID()
+	fs.requestSave()
+	return id, err
+}
+
+func (fs *fileStore) Put(id int, entry hashedEntry) error {
+	err := fs.memoryStore.Put(id, entry)
+	fs.requestSave()
+	return err
+}
+
+func (fs *fileStore) Delete(id int) (bool, error) {
+	deleted, err := fs.memoryStore.Delete(id)
+	if deleted {
+		fs.requestSave()
+	}
+	return deleted, err
+}
+
+// Close stops the background saves and writes the data file one last time.
+func (fs *fileStore) Close() error {
+	close(fs.stopSaver)
+	<-fs.saverDone
+	return fs.save()
+}
+
+func (fs *fileStore) load() error {
+	content, err := os.ReadFile(fs.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// A corrupt data file is not replaced by an empty one, the hashes it holds
+	// would be lost on the next save.
+	var data persistedData
+	if err := json.Unmarshal(content, &data); err != nil {
+		return fmt.Errorf("corrupt data file %s: %w", fs.path, err)
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.counter.Store(int64(data.Counter))
+	// Restore in id order so the oldest hashes are evicted first if the store is full.
+	for _, id := range slices.Sorted(maps.Keys(data.Hashes)) {
+		fs.put(id, data.Hashes[id].hashedEntry())
+	}
+	return nil
+}
+
+// save writes all hashes to the data file. The data is written and synced to
+// a temporary file first which then replaces the data file so that the data
+// file is never left partially written, even by a crash. A failed save leaves
+// the data file as it was and can simply be retried.
+func (fs *fileStore) save() error {
+	fs.saveMutex.Lock()
+	defer fs.saveMutex.Unlock()
+
+	fs.mutex.RLock()
+	data := persistedData{
+		Counter: int(fs.counter.Load()),
+		Hashes:  make(map[int]persistedEntry, len(fs.hashes)),
+	}
+	for id, entry := range fs.hashes {
+		data.Hashes[id] = newPersistedEntry(entry)
+	}
+	fs.mutex.RUnlock()
+
+	content, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(fs.path), filepath.Base(fs.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), fs.path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(fs.path))
+}
+
+// syncDir makes a rename in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// requestSave schedules a write of the data file. Requests made while a
+// write is already scheduled are coalesced into it.
+func (fs *fileStore) requestSave() {
+	select {
+	case fs.saveRequests <- struct{}{}:
+	default:
+	}
+}
+
+// saveInBackground writes the data file when a save is requested. A failed
+// save is retried after saveRetryDelay even if no further save is requested.
+func (fs *fileStore) saveInBackground() {
+	defer close(fs.saverDone)
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-fs.saveRequests:
+		case <-retry:
+		case <-fs.stopSaver:
+			return
+		}
+		retry = nil
+		if err := fs.save(); err != nil {
+			log.Printf("unable to save data file %s: %v", fs.path, err)
+			retry = time.After(saveRetryDelay)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func openTestFileStore(t *testing.T, path string) *fileStore {
+	t.Helper()
+	store, err := newFileStore(path, 0)
+	if err != nil {
+		t.Fatalf("newFileStore: %v", err)
+	}
+	return store
+}
+
+func TestFileStoreSurvivesARestart(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "hashes.json")
+	entry := hashedEntry{algorithm: "sha256", encoding: "base64", salt: []byte("salt"), hash: "hash", createdAt: time.Now().UTC().Truncate(time.Second)}
+
+	store := openTestFileStore(t, path)
+	for range 2 {
+		id, err := store.NextID()
+		if err != nil {
+			t.Fatalf("NextID: %v", err)
+		}
+		if err := store.Put(id, entry); err != nil {
+			t.Fatalf("Put(%d): %v", id, err)
+		}
+	}
+	// The newest hash is deleted, its id must not be handed out again.
+	if deleted, err := store.Delete(2); err != nil || !deleted {
+		t.Fatalf("Delete(2): got %v, %v", deleted, err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// The data file is written through a temporary file that must not be left behind.
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != "hashes.json" {
+		t.Errorf("files after Close: got %v, want only hashes.json", files)
+	}
+
+	store = openTestFileStore(t, path)
+	defer store.Close()
+	restored, ok, err := store.Get(1)
+	if err != nil || !ok {
+		t.Fatalf("Get(1) after the restart: got %v, %v", ok, err)
+	}
+	if restored.String() != entry.String() || restored.algorithm != entry.algorithm || !restored.createdAt.Equal(entry.createdAt) {
+		t.Errorf("Get(1) after the restart: got %+v, want %+v", restored, entry)
+	}
+	if ids, err := store.IDs(); err != nil || !slices.Equal(ids, []int{1}) {
+		t.Errorf("IDs after the restart: got %v, %v, want [1]", ids, err)
+	}
+	if id, err := store.NextID(); err != nil || id != 3 {
+		t.Errorf("NextID after the restart: got %d, %v, want 3, the deleted id 2 can't be reused", id, err)
+	}
+}
+
+func TestFileStoreMissingFileStartsEmpty(t *testing.T) {
+	store := openTestFileStore(t, filepath.Join(t.TempDir(), "hashes.json"))
+	defer store.Close()
+	if ids, err := store.IDs(); err != nil || len(ids) != 0 {
+		t.Errorf("IDs: got %v, %v, want none", ids, err)
+	}
+	if id, err := store.NextID(); err != nil || id != 1 {
+		t.Errorf("NextID: got %d, %v, want 1", id, err)
+	}
+}
+
+func TestFileStoreCorruptFileIsKept(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hashes.json")
+	corrupt := []byte("{not json")
+	if err := os.WriteFile(path, corrupt, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if store, err := newFileStore(path, 0); err == nil {
+		store.Close()
+		t.Fatal("newFileStore: got no error for a corrupt data file")
+	}
+	// The corrupt file must not be replaced, the hashes it holds may still be recovered by hand.
+	if content, err := os.ReadFile(path); err != nil || string(content) != string(corrupt) {
+		t.Errorf("data file after the failed load: got %q, %v, want %q", content, err, corrupt)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// hashIDHeader carries the id of a streamed hash in the 103 Early Hints
+// response, before the body has been read.
+const hashIDHeader = "X-Hash-Id"
+
+// progressTracker holds the progress of the streamed bodies, by hash id, while
+// they are read and until their hash is stored.
+type progressTracker struct {
+	mutex    sync.Mutex
+	progress map[int]*bodyProgress
+}
+
+// bodyProgress counts the bytes read of a body of total bytes, -1 if the
+// length is unknown.
+type bodyProgress struct {
+	read  atomic.Int64
+	total int64
+}
+
+func (pt *progressTracker) track(hashId int, total int64) *bodyProgress {
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+	if pt.progress == nil {
+		pt.progress = make(map[int]*bodyProgress)
+	}
+	progress := &bodyProgress{total: total}
+	pt.progress[hashId] = progress
+	return progress
+}
+
+func (pt *progressTracker) get(hashId int) (*bodyProgress, bool) {
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+	progress, ok := pt.progress[hashId]
+	return progress, ok
+}
+
+func (pt *progressTracker) remove(hashId int) {
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+	delete(pt.progress, hashId)
+}
+
+// reader returns r counting the bytes read into the progress.
+func (bp *bodyProgress) reader(r io.ReadCloser) io.ReadCloser {
+	return &progressReader{ReadCloser: r, progress: bp}
+}
+
+type progressReader struct {
+	io.ReadCloser
+	progress *bodyProgress
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.ReadCloser.Read(p)
+	pr.progress.read.Add(int64(n))
+	return n, err
+}
+
+// hashProgress reports how much of a streamed body has been hashed as
+// {"id":<id>,"bytes_read":<n>,"bytes_total":<n>,"percent":<p>}. The total and
+// percent are left out if the client didn't send a Content-Length. A hash
+// that isn't being streamed is reported as {"id":<id>,"percent":100}.
+func (hs *hashStore) hashProgress(w http.ResponseWriter, r *http.Request) {
+	id, err := hs.parseID(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/hash/"), "/progress"))
+	if err != nil {
+		writeJSONError(w, httpBadRequest, "Invalid hash id.")
+		return
+	}
+
+	response := struct {
+		ID         interface{} `json:"id"`
+		BytesRead  *int64      `json:"bytes_read,omitempty"`
+		BytesTotal *int64      `json:"bytes_total,omitempty"`
+		Percent    *float64    `json:"percent,omitempty"`
+	}{ID: hs.jsonID(id)}
+	if progress, ok := hs.progress.get(id); ok {
+		read := progress.read.Load()
+		response.BytesRead = &read
+		if progress.total > 0 {
+			percent := min(100, float64(read)*100/float64(progress.total))
+			response.BytesTotal = &progress.total
+			response.Percent = &percent
+		}
+	} else {
+		exists, err := hs.hashExists(id)
+		if err != nil {
+			log.Printf("request %s: unable to get hash id %d: %v", requestIDFromContext(r.Context()), id, err)
+			writeJSONError(w, httpInternalServerError, "Internal server error.")
+			return
+		}
+		if !exists {
+			writeJSONError(w, httpNotFound, "Hash not found.")
+			return
+		}
+		percent := 100.0
+		response.Percent = &percent
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(response)
+	logWriteError(r, err)
+}
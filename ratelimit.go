@@ -0,0 +1,99 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// idleLimiterTimeout is how long a client's bucket is kept after its last
+// request.
+const idleLimiterTimeout = 10 * time.Minute
+
+// tokenBucket holds the tokens available to a single client.
+type tokenBucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+// rateLimiter is a per client IP token bucket rate limiter.
+type rateLimiter struct {
+	mutex     sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:      rate,
+		burst:     float64(burst),
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// allow takes a token from the client's bucket. When the bucket is empty it
+// returns false and how long until the next token is available.
+func (rl *rateLimiter) allow(client string) (bool, time.Duration) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(rl.lastSweep) > idleLimiterTimeout {
+		rl.removeIdleBuckets(now)
+	}
+
+	bucket, ok := rl.buckets[client]
+	if !ok {
+		bucket = &tokenBucket{tokens: rl.burst}
+		rl.buckets[client] = bucket
+	} else {
+		bucket.tokens = math.Min(rl.burst, bucket.tokens+now.Sub(bucket.lastSeen).Seconds()*rl.rate)
+	}
+	bucket.lastSeen = now
+
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / rl.rate * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// removeIdleBuckets drops the buckets of clients that have been idle for a
+// while, so the map doesn't grow without bound. Must be called with the
+// mutex held.
+func (rl *rateLimiter) removeIdleBuckets(now time.Time) {
+	for client, bucket := range rl.buckets {
+		if now.Sub(bucket.lastSeen) > idleLimiterTimeout {
+			delete(rl.buckets, client)
+		}
+	}
+	rl.lastSweep = now
+}
+
+// rateLimited applies the limiter to POST requests. Other methods are not
+// limited.
+func rateLimited(rl *rateLimiter, next http.HandlerFunc) http.HandlerFunc {
+	if rl == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			client, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				client = r.RemoteAddr
+			}
+			if ok, retryAfter := rl.allow(client); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+				writeJSONError(w, httpTooManyRequests, "Too many requests.")
+				return
+			}
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// Storage stores the computed hashes and allocates their ids. The handlers
+// only access the hashes through it so that they don't depend on the active
+// backend.
+type Storage interface {
+	// NextID allocates the id of a new hash.
+	NextID() (int, error)
+	// LastID returns the most recently allocated id, 0 if none was allocated yet.
+	LastID() (int, error)
+	// Put stores the hash computed for id.
+	Put(id int, entry hashedEntry) error
+	// Get returns the hash stored for id, false if there is none.
+	Get(id int) (hashedEntry, bool, error)
+	// Peek is Get without counting as an access, for the least recently
+	// accessed eviction.
+	Peek(id int) (hashedEntry, bool, error)
+	// Delete removes the hash stored for id, false if there was none.
+	Delete(id int) (bool, error)
+	// IDs returns the ids of all stored hashes in ascending order.
+	IDs() ([]int, error)
+	Close() error
+}
+
+// openStorage returns the Storage selected by the command line options.
+// The hashes are kept in memory unless a data file, a database or a Redis
+// server is given. More than one shard splits the in-memory hashes over
+// separately locked shards.
+func openStorage(dataFile, dbPath, redisAddr string, maxHashes, shards int) (Storage, error) {
+	selected := 0
+	for _, option := range []string{dataFile, dbPath, redisAddr} {
+		if option != "" {
+			selected++
+		}
+	}
+
+	switch {
+	case selected > 1:
+		return nil, errors.New("only one of -data-file, -db-path and -redis-addr can be used")
+	case maxHashes > 0 && (dbPath != "" || redisAddr != ""):
+		return nil, errors.New("-max-hashes is only supported by the in-memory and data file storage")
+	case shards < 1:
+		return nil, errors.New("-hash-shards must be at least 1")
+	case shards > 1 && (selected > 0 || maxHashes > 0):
+		return nil, errors.New("-hash-shards is only supported by the in-memory storage without -max-hashes")
+	case redisAddr != "":
+		return newRedisStore(redisAddr)
+	case dbPath != "":
+		return newSQLiteStore(dbPath)
+	case dataFile != "":
+		return newFileStore(dataFile, maxHashes)
+	case shards > 1:
+		return newShardedStore(shards), nil
+	default:
+		return newMemoryStore(maxHashes), nil
+	}
+}
+
+// memoryStore is the default Storage, the hashes are kept in a map.
+// When maxHashes is set, the least recently accessed hashes are evicted
+// to keep at most maxHashes of them.
+type memoryStore struct {
+	// counter is atomic so that allocating an id doesn't contend with the
+	// map accesses guarded by mutex.
+	counter atomic.Int64
+	// mutex is read-locked by the lookups that don't change the access order.
+	mutex  sync.RWMutex
+	hashes map[int]hashedEntry
+
+	maxHashes int
+	// accessOrder holds the ids from the most to the least recently accessed.
+	accessOrder *list.List
+	accessed    map[int]*list.Element
+}
+
+func newMemoryStore(maxHashes int) *memoryStore {
+	return &memoryStore{
+		hashes:      make(map[int]hashedEntry),
+		maxHashes:   maxHashes,
+		accessOrder: list.New(),
+		accessed:    make(map[int]*list.Element),
+	}
+}
+
+// put stores the entry and evicts the least recently accessed ones if the
+// store is full. The caller must hold the mutex.
+func (ms *memoryStore) put(id int, entry hashedEntry) {
+	ms.hashes[id] = entry
+	if ms.maxHashes <= 0 {
+		return
+	}
+
+	ms.touch(id)
+	for len(ms.hashes) > ms.maxHashes {
+		oldest := ms.accessOrder.Back()
+		ms.remove(oldest.Value.(int))
+	}
+}
+
+// touch marks id as the most recently accessed. The caller must hold the mutex.
+func (ms *memoryStore) touch(id int) {
+	if ms.maxHashes <= 0 {
+		return
+	}
+	if element, ok := ms.accessed[id]; ok {
+		ms.accessOrder.MoveToFront(element)
+		return
+	}
+	ms.accessed[id] = ms.accessOrder.PushFront(id)
+}
+
+// remove deletes id. The caller must hold the mutex.
+func (ms *memoryStore) remove(id int) {
+	delete(ms.hashes, id)
+	if element, ok := ms.accessed[id]; ok {
+		ms.accessOrder.Remove(element)
+		delete(ms.accessed, id)
+	}
+}
+
+func (ms *memoryStore) NextID() (int, error) {
+	return int(ms.counter.Add(1)), nil
+}
+
+func (ms *memoryStore) LastID() (int, error) {
+	return int(ms.counter.Load()), nil
+}
+
+func (ms *memoryStore) Put(id int, entry hashedEntry) error {
+	ms.mutex.Lock()
+	ms.put(id, entry)
+	ms.mutex.Unlock()
+	return nil
+}
+
+func (ms *memoryStore) Get(id int) (hashedEntry, bool, error) {
+	// Without a limit there is no access order to update, so concurrent
+	// lookups can share the lock.
+	if ms.maxHashes <= 0 {
+		ms.mutex.RLock()
+		entry, ok := ms.hashes[id]
+		ms.mutex.RUnlock()
+		return entry, ok, nil
+	}
+
+	ms.mutex.Lock()
+	entry, ok := ms.hashes[id]
+	if ok {
+		ms.touch(id)
+	}
+	ms.mutex.Unlock()
+	return entry, ok, nil
+}
+
+func (ms *memoryStore) Peek(id int) (hashedEntry, bool, error) {
+	ms.mutex.RLock()
+	entry, ok := ms.hashes[id]
+	ms.mutex.RUnlock()
+	return entry, ok, nil
+}
+
+func (ms *memoryStore) Delete(id int) (bool, error) {
+	ms.mutex.Lock()
+	_, ok := ms.hashes[id]
+	ms.remove(id)
+	ms.mutex.Unlock()
+	return ok, nil
+}
+
+func (ms *memoryStore) IDs() ([]int, error) {
+	ms.mutex.RLock()
+	ids := make([]int, 0, len(ms.hashes))
+	for id := range ms.hashes {
+		ids = append(ids, id)
+	}
+	ms.mutex.RUnlock()
+	slices.Sort(ids)
+	return ids, nil
+}
+
+func (ms *memoryStore) Close() error {
+	return nil
+}
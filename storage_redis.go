@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	redisCounterKey    = "hash_id_counter"
+	redisHashKeyPrefix = "hash:"
+	redisDialTimeout   = 5 * time.Second
+)
+
+// redisStore is a Storage keeping the hashes in Redis so that multiple
+// server instances can share them. The ids are allocated with INCR on a
+// counter key and every hash is stored as JSON under a hash:<id> key.
+// It speaks the Redis protocol(RESP) directly over a single connection.
+type redisStore struct {
+	addr string
+
+	mutex  sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func newRedisStore(addr string) (*redisStore, error) {
+	rs := &redisStore{addr: addr}
+	if _, err := rs.do("PING"); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+func redisHashKey(id int) string {
+	return redisHashKeyPrefix + strconv.Itoa(id)
+}
+
+func (rs *redisStore) NextID() (int, error) {
+	reply, err := rs.do("INCR", redisCounterKey)
+	if err != nil {
+		return 0, err
+	}
+	id, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("unexpected INCR reply: %v", reply)
+	}
+	return int(id), nil
+}
+
+func (rs *redisStore) LastID() (int, error) {
+	reply, err := rs.do("GET", redisCounterKey)
+	if err != nil || reply == nil {
+		return 0, err
+	}
+	return strconv.Atoi(reply.(string))
+}
+
+func (rs *redisStore) Put(id int, entry hashedEntry) error {
+	value, err := json.Marshal(newPersistedEntry(entry))
+	if err != nil {
+		return err
+	}
+	_, err = rs.do("SET", redisHashKey(id), string(value))
+	return err
+}
+
+func (rs *redisStore) Get(id int) (hashedEntry, bool, error) {
+	reply, err := rs.do("GET", redisHashKey(id))
+	if err != nil || reply == nil {
+		return hashedEntry{}, false, err
+	}
+
+	var entry persistedEntry
+	if err := json.Unmarshal([]byte(reply.(string)), &entry); err != nil {
+		return hashedEntry{}, false, err
+	}
+	return entry.hashedEntry(), true, nil
+}
+
+// Peek is Get, Redis doesn't evict by the access order of the server.
+func (rs *redisStore) Peek(id int) (hashedEntry, bool, error) {
+	return rs.Get(id)
+}
+
+func (rs *redisStore) Delete(id int) (bool, error) {
+	reply, err := rs.do("DEL", redisHashKey(id))
+	if err != nil {
+		return false, err
+	}
+	return reply == int64(1), nil
+}
+
+func (rs *redisStore) IDs() ([]int, error) {
+	ids := make([]int, 0)
+	cursor := "0"
+	for {
+		reply, err := rs.do("SCAN", cursor, "MATCH", redisHashKeyPrefix+"*", "COUNT", "1000")
+		if err != nil {
+			return nil, err
+		}
+		page, ok := reply.([]interface{})
+		if !ok || len(page) != 2 {
+			return nil, fmt.Errorf("unexpected SCAN reply: %v", reply)
+		}
+		keys, _ := page[1].([]interface{})
+		for _, key := range keys {
+			id, err := strconv.Atoi(strings.TrimPrefix(key.(string), redisHashKeyPrefix))
+			if err == nil {
+				ids = append(ids, id)
+			}
+		}
+
+		cursor, _ = page[0].(string)
+		if cursor == "0" {
+			break
+		}
+	}
+	slices.Sort(ids)
+	return ids, nil
+}
+
+func (rs *redisStore) Close() error {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	if rs.conn == nil {
+		return nil
+	}
+	err := rs.conn.Close()
+	rs.conn = nil
+	return err
+}
+
+// do sends a command and returns its reply: a string, an int64, a slice of
+// replies or nil. The connection is reestablished after an I/O error.
+func (rs *redisStore) do(args ...string) (interface{}, error) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	if rs.conn == nil {
+		conn, err := net.DialTimeout("tcp", rs.addr, redisDialTimeout)
+		if err != nil {
+			return nil, err
+		}
+		rs.conn = conn
+		rs.reader = bufio.NewReader(conn)
+	}
+
+	var command strings.Builder
+	fmt.Fprintf(&command, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&command, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	reply, err := rs.writeCommand(command.String())
+	var redisErr redisError
+	if err != nil && !errors.As(err, &redisErr) {
+		rs.conn.Close()
+		rs.conn = nil
+	}
+	return reply, err
+}
+
+func (rs *redisStore) writeCommand(command string) (interface{}, error) {
+	if _, err := io.WriteString(rs.conn, command); err != nil {
+		return nil, err
+	}
+	return readRedisReply(rs.reader)
+}
+
+// redisError is an error reply sent by the Redis server.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+func readRedisReply(reader *bufio.Reader) (interface{}, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil || count < 0 {
+			return nil, err
+		}
+		replies := make([]interface{}, count)
+		for i := range replies {
+			if replies[i], err = readRedisReply(reader); err != nil {
+				return nil, err
+			}
+		}
+		return replies, nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply %q", line)
+	}
+}
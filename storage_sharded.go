@@ -0,0 +1,87 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// shardedStore is an in-memory Storage with the hashes split over shards by
+// id, each with its own lock, so operations on different ids don't contend.
+type shardedStore struct {
+	counter atomic.Int64
+	shards  []hashShard
+}
+
+type hashShard struct {
+	mutex  sync.RWMutex
+	hashes map[int]hashedEntry
+}
+
+func newShardedStore(numShards int) *shardedStore {
+	ss := &shardedStore{shards: make([]hashShard, numShards)}
+	for i := range ss.shards {
+		ss.shards[i].hashes = make(map[int]hashedEntry)
+	}
+	return ss
+}
+
+func (ss *shardedStore) shard(id int) *hashShard {
+	return &ss.shards[uint(id)%uint(len(ss.shards))]
+}
+
+func (ss *shardedStore) NextID() (int, error) {
+	return int(ss.counter.Add(1)), nil
+}
+
+func (ss *shardedStore) LastID() (int, error) {
+	return int(ss.counter.Load()), nil
+}
+
+func (ss *shardedStore) Put(id int, entry hashedEntry) error {
+	shard := ss.shard(id)
+	shard.mutex.Lock()
+	shard.hashes[id] = entry
+	shard.mutex.Unlock()
+	return nil
+}
+
+func (ss *shardedStore) Get(id int) (hashedEntry, bool, error) {
+	shard := ss.shard(id)
+	shard.mutex.RLock()
+	entry, ok := shard.hashes[id]
+	shard.mutex.RUnlock()
+	return entry, ok, nil
+}
+
+// Peek is Get, the shards don't track the access order.
+func (ss *shardedStore) Peek(id int) (hashedEntry, bool, error) {
+	return ss.Get(id)
+}
+
+func (ss *shardedStore) Delete(id int) (bool, error) {
+	shard := ss.shard(id)
+	shard.mutex.Lock()
+	_, ok := shard.hashes[id]
+	delete(shard.hashes, id)
+	shard.mutex.Unlock()
+	return ok, nil
+}
+
+func (ss *shardedStore) IDs() ([]int, error) {
+	ids := make([]int, 0)
+	for i := range ss.shards {
+		shard := &ss.shards[i]
+		shard.mutex.RLock()
+		for id := range shard.hashes {
+			ids = append(ids, id)
+		}
+		shard.mutex.RUnlock()
+	}
+	slices.Sort(ids)
+	return ids, nil
+}
+
+func (ss *shardedStore) Close() error {
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// sqliteDriverName is the database/sql driver used by the SQLite backend.
+// The driver is only linked in when building with the sqlite build tag.
+const sqliteDriverName = "sqlite"
+
+const createHashesTable = `CREATE TABLE IF NOT EXISTS hashes (
+	id         INTEGER PRIMARY KEY,
+	algorithm  TEXT NOT NULL,
+	encoding   TEXT NOT NULL,
+	salt       BLOB,
+	hash       TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL
+)`
+
+// createCounterTable holds the last allocated id in its single row. The
+// highest stored id is not enough, it goes back when the newest hash is
+// deleted and its id would be handed out again after a restart.
+const createCounterTable = `CREATE TABLE IF NOT EXISTS hash_counter (
+	id      INTEGER PRIMARY KEY CHECK (id = 1),
+	last_id INTEGER NOT NULL
+)`
+
+// sqliteStore is a Storage keeping the hashes in a SQLite database.
+type sqliteStore struct {
+	db *sql.DB
+
+	mutex sync.Mutex
+	// counter is restored from the hash_counter table so that ids are never
+	// reused, not even after a restart.
+	counter int
+}
+
+func newSQLiteStore(path string) (*sqliteStore, error) {
+	if !slices.Contains(sql.Drivers(), sqliteDriverName) {
+		return nil, errors.New("built without SQLite support, rebuild with -tags sqlite")
+	}
+
+	db, err := sql.Open(sqliteDriverName, path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(createHashesTable); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("unable to create the hashes table: %w", err)
+	}
+
+	if _, err := db.Exec(createCounterTable); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("unable to create the hash counter table: %w", err)
+	}
+	// A database created before the counter table starts from its highest id.
+	if _, err := db.Exec("INSERT OR IGNORE INTO hash_counter (id, last_id) SELECT 1, COALESCE(MAX(id), 0) FROM hashes"); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("unable to initialize the hash counter: %w", err)
+	}
+
+	ss := &sqliteStore{db: db}
+	if err := db.QueryRow("SELECT last_id FROM hash_counter WHERE id = 1").Scan(&ss.counter); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("unable to read the last hash id: %w", err)
+	}
+	return ss, nil
+}
+
+// NextID allocates the id and persists the counter before returning it.
+func (ss *sqliteStore) NextID() (int, error) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	if _, err := ss.db.Exec("UPDATE hash_counter SET last_id = ? WHERE id = 1", ss.counter+1); err != nil {
+		return 0, err
+	}
+	ss.counter += 1
+	return ss.counter, nil
+}
+
+func (ss *sqliteStore) LastID() (int, error) {
+	ss.mutex.Lock()
+	id := ss.counter
+	ss.mutex.Unlock()
+	return id, nil
+}
+
+func (ss *sqliteStore) Put(id int, entry hashedEntry) error {
+	_, err := ss.db.Exec(
+		"INSERT INTO hashes (id, algorithm, encoding, salt, hash, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		id, entry.algorithm, entry.encoding, entry.salt, entry.hash, entry.createdAt.UTC())
+	return err
+}
+
+func (ss *sqliteStore) Get(id int) (hashedEntry, bool, error) {
+	var entry hashedEntry
+	err := ss.db.QueryRow("SELECT algorithm, encoding, salt, hash, created_at FROM hashes WHERE id = ?", id).
+		Scan(&entry.algorithm, &entry.encoding, &entry.salt, &entry.hash, &entry.createdAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return entry, false, nil
+	}
+	if err != nil {
+		return entry, false, err
+	}
+	return entry, true, nil
+}
+
+// Peek is Get, the database doesn't track the access order.
+func (ss *sqliteStore) Peek(id int) (hashedEntry, bool, error) {
+	return ss.Get(id)
+}
+
+func (ss *sqliteStore) Delete(id int) (bool, error) {
+	result, err := ss.db.Exec("DELETE FROM hashes WHERE id = ?", id)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := result.RowsAffected()
+	return deleted > 0, err
+}
+
+func (ss *sqliteStore) IDs() ([]int, error) {
+	rows, err := ss.db.Query("SELECT id FROM hashes ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]int, 0)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (ss *sqliteStore) Close() error {
+	return ss.db.Close()
+}
@@ -0,0 +1,56 @@
+//go:build sqlite
+
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func openTestSQLiteStore(t *testing.T, path string) *sqliteStore {
+	t.Helper()
+	store, err := newSQLiteStore(path)
+	if err != nil {
+		t.Fatalf("newSQLiteStore: %v", err)
+	}
+	return store
+}
+
+func TestSQLiteStoreSurvivesARestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hashes.db")
+	entry := hashedEntry{algorithm: "sha256", encoding: "base64", salt: []byte("salt"), hash: "hash", createdAt: time.Now().UTC().Truncate(time.Second)}
+
+	store := openTestSQLiteStore(t, path)
+	for range 2 {
+		id, err := store.NextID()
+		if err != nil {
+			t.Fatalf("NextID: %v", err)
+		}
+		if err := store.Put(id, entry); err != nil {
+			t.Fatalf("Put(%d): %v", id, err)
+		}
+	}
+	// The newest hash is deleted, its id must not be handed out again.
+	if deleted, err := store.Delete(2); err != nil || !deleted {
+		t.Fatalf("Delete(2): got %v, %v", deleted, err)
+	}
+	store.Close()
+
+	store = openTestSQLiteStore(t, path)
+	defer store.Close()
+	restored, ok, err := store.Get(1)
+	if err != nil || !ok {
+		t.Fatalf("Get(1) after the restart: got %v, %v", ok, err)
+	}
+	if restored.String() != entry.String() || restored.algorithm != entry.algorithm || !restored.createdAt.Equal(entry.createdAt) {
+		t.Errorf("Get(1) after the restart: got %+v, want %+v", restored, entry)
+	}
+	if ids, err := store.IDs(); err != nil || !slices.Equal(ids, []int{1}) {
+		t.Errorf("IDs after the restart: got %v, %v, want [1]", ids, err)
+	}
+	if id, err := store.NextID(); err != nil || id != 3 {
+		t.Errorf("NextID after the restart: got %d, %v, want 3, the deleted id 2 can't be reused", id, err)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"time"
+)
+
+// defaultMaxUploadBytes is the default -max-upload-bytes, the limit of an
+// application/octet-stream or multipart/form-data body.
+const defaultMaxUploadBytes = 1 << 30
+
+// isStreamRequest reports whether the content to hash is the raw request body
+// or an uploaded file.
+func isStreamRequest(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "application/octet-stream" || mediaType == "multipart/form-data"
+}
+
+// createStreamedHash hashes an application/octet-stream body or the file part
+// of a multipart/form-data body. The body is no longer readable once the
+// request has ended, so it is hashed while it is read and only the result is
+// stored after the hash delay. The id is allocated and sent in a 103 Early
+// Hints response before the body is read, so that the client can follow the
+// progress of a large upload. A retry with a known Idempotency-Key gets no
+// early hint, it is answered with the ids of the first request.
+func (hs *hashStore) createStreamedHash(w http.ResponseWriter, r *http.Request, algorithm, encoding string) {
+	if algorithm == bcryptAlgorithm {
+		writeJSONError(w, httpBadRequest, "bcrypt can't hash a streamed body.")
+		return
+	}
+
+	// A concurrent request with the same Idempotency-Key can still be first
+	// to use it, the hinted id is then abandoned and superseded by the ids of
+	// that request in the final response.
+	var hashId int
+	if key := r.Header.Get(idempotencyKeyHeader); key == "" || !hs.idempotency.has(key) {
+		var err error
+		hashId, err = hs.reserveHash()
+		if errors.Is(err, errHashQueueFull) {
+			w.Header().Set("Retry-After", "1")
+			writeJSONError(w, httpServiceUnavailable, "Too many pending hashes, try again later.")
+			return
+		}
+		if err != nil {
+			log.Printf("request %s: unable to allocate a hash id: %v", requestIDFromContext(r.Context()), err)
+			writeJSONError(w, httpInternalServerError, "Internal server error.")
+			return
+		}
+		w.Header().Set(hashIDHeader, hs.formatID(hashId))
+		w.WriteHeader(httpEarlyHints)
+		w.Header().Del(hashIDHeader)
+	}
+	// The reserved id is abandoned if the body can't be hashed, or an earlier
+	// request with the same Idempotency-Key already has an id.
+	scheduled := false
+	defer func() {
+		if hashId != 0 && !scheduled {
+			hs.abandonHash(hashId)
+		}
+	}()
+
+	// A large upload can take longer than the read and write timeouts, it
+	// gets -upload-timeout instead. The client still has to keep sending, the
+	// read deadline is pushed forward by -read-timeout after every read.
+	rc := http.NewResponseController(w)
+	uploadDeadline := time.Now().Add(hs.uploadTimeout)
+	rc.SetWriteDeadline(uploadDeadline)
+	body := &deadlineReader{ReadCloser: r.Body, rc: rc, idle: hs.readTimeout, end: uploadDeadline}
+	body.extend()
+	r.Body = body
+
+	if hashId != 0 {
+		r.Body = hs.progress.track(hashId, r.ContentLength).reader(r.Body)
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, hs.maxUploadBytes)
+	var content io.Reader = r.Body
+	var maxBytesError *http.MaxBytesError
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		part, err := filePart(r)
+		if errors.As(err, &maxBytesError) {
+			writeJSONError(w, httpBadRequest, "Request body too large.")
+			return
+		}
+		if err != nil {
+			writeJSONError(w, httpBadRequest, "A file part is required.")
+			return
+		}
+		defer part.Close()
+		content = part
+	}
+	// An Idempotency-Key is bound to the digest of the streamed content.
+	var contentDigest hash.Hash
+	if r.Header.Get(idempotencyKeyHeader) != "" {
+		contentDigest = sha256.New()
+		content = io.TeeReader(content, contentDigest)
+	}
+
+	entry, n, err := hs.computeStreamHash(content, algorithm, encoding)
+	if errors.As(err, &maxBytesError) {
+		writeJSONError(w, httpBadRequest, "Request body too large.")
+		return
+	}
+	if err != nil {
+		log.Printf("request %s: unable to hash body: %v", requestIDFromContext(r.Context()), err)
+		writeJSONError(w, httpBadRequest, "Unable to read request body.")
+		return
+	}
+	if n == 0 {
+		writeJSONError(w, httpBadRequest, "Password is required.")
+		return
+	}
+	hs.bytesIn.Add(n)
+
+	var digest string
+	if contentDigest != nil {
+		digest = requestDigest(r, contentDigest.Sum(nil))
+	}
+	spanCtx := hashContext(r)
+	hs.scheduleAndRespond(w, r, false, digest, func() ([]int, error) {
+		// The key of the retry expired, or its request failed, while the
+		// body was read.
+		if hashId == 0 {
+			var err error
+			if hashId, err = hs.reserveHash(); err != nil {
+				return nil, err
+			}
+		}
+		hs.scheduleReservedHash(spanCtx, hashId, func() (hashedEntry, error) {
+			return entry, nil
+		})
+		scheduled = true
+		return []int{hashId}, nil
+	})
+}
+
+// deadlineReader moves the read deadline of a request to idle after the last
+// read, but never past end.
+type deadlineReader struct {
+	io.ReadCloser
+	rc   *http.ResponseController
+	idle time.Duration
+	end  time.Time
+}
+
+func (dr *deadlineReader) Read(p []byte) (int, error) {
+	n, err := dr.ReadCloser.Read(p)
+	if n > 0 {
+		dr.extend()
+	}
+	return n, err
+}
+
+func (dr *deadlineReader) extend() {
+	deadline := dr.end
+	if next := time.Now().Add(dr.idle); dr.idle > 0 && next.Before(deadline) {
+		deadline = next
+	}
+	dr.rc.SetReadDeadline(deadline)
+}
+
+// filePart returns the "file" part of a multipart/form-data body, the parts
+// before it are skipped.
+func filePart(r *http.Request) (*multipart.Part, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == "file" {
+			return part, nil
+		}
+	}
+}
+
+// computeStreamHash hashes the salted content of r without buffering it and
+// returns the number of bytes read.
+func (hs *hashStore) computeStreamHash(r io.Reader, algorithm, encoding string) (hashedEntry, int64, error) {
+	start := time.Now()
+	defer func() {
+		hs.storeHashComputeDuration(time.Since(start))
+	}()
+
+	entry := hashedEntry{
+		algorithm: algorithm,
+		encoding:  encoding,
+		createdAt: time.Now(),
+	}
+	var err error
+	entry.salt, err = newSalt()
+	if err != nil {
+		return entry, 0, err
+	}
+
+	h := hs.newHash(algorithm)
+	h.Write(entry.salt)
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return entry, n, err
+	}
+	h.Write(hs.pepper)
+	entry.hash = encodings[encoding](h.Sum(nil))
+	return entry, n, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+var errHashWaitTimeout = errors.New("timed out waiting for the hash")
+
+type skipHashDelayKey struct{}
+
+// hashContext returns the context the hashes of a request are scheduled with.
+// The hashes are computed after the request has ended, so it only keeps the
+// request's values, e.g. its trace. With ?sync=true the hash delay is skipped
+// and a ?callback_url=... is notified once each hash is stored.
+func hashContext(r *http.Request) context.Context {
+	ctx := context.WithoutCancel(r.Context())
+	if r.URL.Query().Get("sync") == "true" {
+		ctx = context.WithValue(ctx, skipHashDelayKey{}, true)
+	}
+	if callbackURL := r.URL.Query().Get("callback_url"); callbackURL != "" {
+		ctx = context.WithValue(ctx, callbackURLKey{}, callbackURL)
+	}
+	return ctx
+}
+
+// skipHashDelay reports whether the hash should be computed without waiting
+// for the hash delay.
+func skipHashDelay(ctx context.Context) bool {
+	skip, _ := ctx.Value(skipHashDelayKey{}).(bool)
+	return skip
+}
+
+// waitForHash waits until hashComputed is closed, for at most -max-wait.
+func (hs *hashStore) waitForHash(ctx context.Context, hashComputed <-chan struct{}) error {
+	select {
+	case <-hashComputed:
+		return nil
+	case <-time.After(hs.config.Load().maxWait()):
+		return errHashWaitTimeout
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// respondWithHashes waits for the hashes of a ?sync=true request and writes
+// them in the same shapes as their ids: a single hash as plain text, a batch
+// as a JSON array and the hash of a JSON request as {"id":<id>,"hash":<hash>}.
+func (hs *hashStore) respondWithHashes(w http.ResponseWriter, r *http.Request, jsonRequest bool, hashIds []int) {
+	hashes, ok := hs.collectHashes(w, r, hashIds)
+	if !ok {
+		return
+	}
+
+	var response interface{}
+	switch {
+	case jsonRequest:
+		response = idAndHash{hs.jsonID(hashIds[0]), hashes[0]}
+	case len(hashes) > 1:
+		response = hashes
+	default:
+		writeText(w, r, hashes[0])
+		return
+	}
+	writeJSON(w, r, response)
+}
+
+// idAndHash is a hash along with its id.
+type idAndHash struct {
+	ID   interface{} `json:"id"`
+	Hash string      `json:"hash"`
+}
+
+// respondWithIDsAndHashes writes the hashes computed without a hash delay
+// along with their ids, as {"id":<id>,"hash":<hash>} or, for a batch, an
+// array of them.
+func (hs *hashStore) respondWithIDsAndHashes(w http.ResponseWriter, r *http.Request, hashIds []int) {
+	hashes, ok := hs.collectHashes(w, r, hashIds)
+	if !ok {
+		return
+	}
+
+	response := make([]idAndHash, len(hashIds))
+	for i, id := range hashIds {
+		response[i] = idAndHash{hs.jsonID(id), hashes[i]}
+	}
+	if len(response) == 1 {
+		writeJSON(w, r, response[0])
+		return
+	}
+	writeJSON(w, r, response)
+}
+
+// collectHashes waits for the pending hashes and returns them. The error
+// response is written if a hash can't be returned.
+func (hs *hashStore) collectHashes(w http.ResponseWriter, r *http.Request, hashIds []int) ([]string, bool) {
+	hashes := make([]string, 0, len(hashIds))
+	for _, id := range hashIds {
+		hs.pendingHashesMutex.Lock()
+		hashComputed, pending := hs.pendingHashes[id]
+		hs.pendingHashesMutex.Unlock()
+		if pending {
+			err := hs.waitForHash(r.Context(), hashComputed)
+			if errors.Is(err, errHashWaitTimeout) {
+				writeJSONError(w, httpGatewayTimeout, "Timed out waiting for the hash.")
+				return nil, false
+			}
+			if err != nil {
+				return nil, false
+			}
+		}
+
+		entry, ok, err := hs.storage.Get(id)
+		if err != nil {
+			log.Printf("request %s: unable to get hash id %d: %v", requestIDFromContext(r.Context()), id, err)
+			writeJSONError(w, httpInternalServerError, "Internal server error.")
+			return nil, false
+		}
+		if !ok {
+			// The hash was abandoned, e.g. by a shutdown.
+			writeJSONError(w, httpServiceUnavailable, "The hash was not computed.")
+			return nil, false
+		}
+		hashes = append(hashes, entry.String())
+	}
+	return hashes, true
+}
+
+// writeJSON writes a 200 response with the JSON encoded response.
+func writeJSON(w http.ResponseWriter, r *http.Request, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpOK)
+	err := json.NewEncoder(w).Encode(response)
+	logWriteError(r, err)
+}
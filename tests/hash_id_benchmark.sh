@@ -0,0 +1,13 @@
+#!/bin/bash
+
+# Measures POST /hash throughput under concurrent load. Hash ids are allocated
+# with an atomic counter instead of under the hash store mutex, so the
+# requests per second should keep up as the concurrency grows. Start the server
+# with -hash-delay 0 so that the hashes are stored while the ids are allocated.
+
+NUM_HASH_ITERATIONS=100000
+
+for CONCURRENCY in 1 10 50; do
+	echo "POST /hash with $CONCURRENCY concurrent clients:"
+	ab -T 'application/x-www-form-urlencoded' -c $CONCURRENCY -n $NUM_HASH_ITERATIONS -p post.data http://localhost:8080/hash | grep "Requests per second"
+done
@@ -0,0 +1,14 @@
+#!/bin/bash
+
+# Measures concurrent GET /hash/<id> throughput. Lookups share a read lock on
+# the hash store, so the requests per second should keep up as the concurrency
+# grows. Start the server with -hash-delay 0.
+
+NUM_GET_ITERATIONS=100000
+
+curl -s --data "password=testPassword" http://localhost:8080/hash > /dev/null
+
+for CONCURRENCY in 1 10 50; do
+	echo "GET /hash/1 with $CONCURRENCY concurrent clients:"
+	ab -c $CONCURRENCY -n $NUM_GET_ITERATIONS http://localhost:8080/hash/1 | grep "Requests per second"
+done
@@ -0,0 +1,21 @@
+#!/bin/bash
+
+# Compares concurrent POST /hash and GET /hash/<id> throughput of the single
+# lock in-memory storage with the sharded one.
+
+LISTEN_ADDR=localhost:8084
+NUM_ITERATIONS=100000
+CONCURRENCY=50
+
+for SHARDS in 1 16; do
+	../hash_server -listen-addr $LISTEN_ADDR -hash-delay 0 -hash-shards $SHARDS > /dev/null 2>&1 &
+	SERVER_PID=$!
+	sleep 1
+
+	echo "-hash-shards $SHARDS:"
+	ab -T 'application/x-www-form-urlencoded' -c $CONCURRENCY -n $NUM_ITERATIONS -p post.data http://$LISTEN_ADDR/hash | grep "Requests per second"
+	ab -c $CONCURRENCY -n $NUM_ITERATIONS http://$LISTEN_ADDR/hash/1 | grep "Requests per second"
+
+	kill $SERVER_PID
+	wait $SERVER_PID
+done
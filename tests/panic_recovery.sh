@@ -0,0 +1,28 @@
+#!/bin/bash
+
+# Calls a handler that panics and checks that the server returns 500 and keeps
+# serving requests.
+
+LISTEN_ADDR=localhost:8083
+LOG_FILE=$(mktemp)
+BINARY=$(mktemp)
+
+go build -tags panictest -o $BINARY .. || exit 1
+$BINARY -listen-addr $LISTEN_ADDR > $LOG_FILE 2>&1 &
+SERVER_PID=$!
+sleep 1
+
+STATUS=$(curl -s -o /dev/null -w "%{http_code}" http://$LISTEN_ADDR/panic)
+COUNT=$(curl -s http://$LISTEN_ADDR/count)
+kill $SERVER_PID
+wait $SERVER_PID
+
+if [ "$STATUS" != "500" ] || [ -z "$COUNT" ]; then
+	echo "FAIL: expected 500 and a running server, got status $STATUS and /count response '$COUNT'"
+	cat $LOG_FILE
+	rm $LOG_FILE $BINARY
+	exit 1
+fi
+
+echo "PASS: panics are recovered"
+rm $LOG_FILE $BINARY
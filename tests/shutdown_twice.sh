@@ -0,0 +1,24 @@
+#!/bin/bash
+
+# Calls /shutdown twice and checks that the server does not panic.
+
+LISTEN_ADDR=localhost:8081
+LOG_FILE=$(mktemp)
+
+../hash_server -listen-addr $LISTEN_ADDR > $LOG_FILE 2>&1 &
+SERVER_PID=$!
+sleep 1
+
+curl -s http://$LISTEN_ADDR/shutdown &
+curl -s http://$LISTEN_ADDR/shutdown &
+wait $SERVER_PID
+
+if grep -q panic $LOG_FILE; then
+	echo "FAIL: server panicked on the second /shutdown"
+	cat $LOG_FILE
+	rm $LOG_FILE
+	exit 1
+fi
+
+echo "PASS: repeated /shutdown requests are handled"
+rm $LOG_FILE
@@ -0,0 +1,17 @@
+#!/bin/bash
+
+# Measures the /stats response time before and after a large number of hash
+# requests have been recorded. The two "Time per request" values should be
+# roughly the same since neither the average nor the percentiles are computed
+# by iterating over all recorded durations.
+
+NUM_STATS_ITERATIONS=10000
+NUM_HASH_ITERATIONS=100000
+
+echo "/stats with an empty store:"
+ab -n $NUM_STATS_ITERATIONS  http://localhost:8080/stats | grep "Time per request" | head -1
+
+ab -T 'application/x-www-form-urlencoded'  -n $NUM_HASH_ITERATIONS -p post.data http://localhost:8080/hash/  > /dev/null
+
+echo "/stats after $NUM_HASH_ITERATIONS hash requests:"
+ab -n $NUM_STATS_ITERATIONS  http://localhost:8080/stats | grep "Time per request" | head -1
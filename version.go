@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime/debug"
+)
+
+// Build information, set at build time with
+// -ldflags "-X main.version=... -X main.gitCommit=... -X main.buildDate=...".
+var (
+	version   string
+	gitCommit string
+	buildDate string
+)
+
+// buildInfo returns the build information. Values not set at build time are
+// taken from the module and VCS information Go embeds in the binary.
+func buildInfo() map[string]string {
+	info := map[string]string{
+		"version":    version,
+		"git_commit": gitCommit,
+		"build_date": buildDate,
+	}
+	if embedded, ok := debug.ReadBuildInfo(); ok {
+		if info["version"] == "" {
+			info["version"] = embedded.Main.Version
+		}
+		for _, setting := range embedded.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && info["git_commit"] == "":
+				info["git_commit"] = setting.Value
+			case setting.Key == "vcs.time" && info["build_date"] == "":
+				info["build_date"] = setting.Value
+			}
+		}
+	}
+	return info
+}
+
+// versionInfo reports which build is running.
+func versionInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeJSONError(w, httpMethodNotAllowed, "Method not allowed.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(buildInfo())
+	logWriteError(r, err)
+}
@@ -0,0 +1,54 @@
+package main
+
+import "errors"
+
+var errHashQueueFull = errors.New("hash queue is full")
+
+// hashWorkerPool computes the hashes on a fixed number of goroutines, so a
+// burst of requests doesn't start a goroutine per hash. A slot is reserved
+// for every scheduled hash, the jobs channel can therefore never be full.
+type hashWorkerPool struct {
+	jobs  chan func()
+	slots chan struct{}
+}
+
+func newHashWorkerPool(workers, queueSize int) *hashWorkerPool {
+	pool := &hashWorkerPool{
+		jobs:  make(chan func(), queueSize),
+		slots: make(chan struct{}, queueSize),
+	}
+	for range workers {
+		go pool.work()
+	}
+	return pool
+}
+
+// reserve takes a queue slot, false if the queue is full.
+func (pool *hashWorkerPool) reserve() bool {
+	select {
+	case pool.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// release frees a reserved slot.
+func (pool *hashWorkerPool) release() {
+	<-pool.slots
+}
+
+// queue returns a function that hands the job, which must hold a reserved
+// slot, to the workers.
+func (pool *hashWorkerPool) queue(job func()) func() {
+	return func() {
+		pool.jobs <- job
+	}
+}
+
+func (pool *hashWorkerPool) work() {
+	for job := range pool.jobs {
+		job()
+		pool.release()
+	}
+}